@@ -33,6 +33,10 @@ const (
 	ERR16   = "AKC0016"
 	ERR17   = "AKC0017"
 	ERR18   = "AKC0018"
+	ERR19   = "AKC0019"
+	ERR20   = "AKC0020"
+	ERR21   = "AKC0021"
+	ERR22   = "AKC0022"
 )
 
 var ResCodeDict = map[string]string{
@@ -55,6 +59,10 @@ var ResCodeDict = map[string]string{
 	"AKC0016": "Proposal Rejected!",
 	"AKC0017": "You have confirmed you cannot reject!",
 	"AKC0018": "Only reject once!",
+	"AKC0019": "Unique constraint violated!",
+	"AKC0020": "Invalid row!",
+	"AKC0021": "Row version conflict!",
+	"AKC0022": "Batch rejected!",
 }
 
 type InvokeResponse struct {
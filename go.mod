@@ -7,6 +7,7 @@ replace github.com/satori/go.uuid v1.2.0 => github.com/satori/go.uuid v1.2.1-0.2
 require (
 	github.com/Knetic/govaluate v3.0.0+incompatible // indirect
 	github.com/fsouza/go-dockerclient v1.6.0 // indirect
+	github.com/golang/protobuf v1.3.2
 	github.com/grpc-ecosystem/go-grpc-middleware v1.1.0 // indirect
 	github.com/hyperledger/fabric v1.4.4
 	github.com/hyperledger/fabric-amcl v0.0.0-20191220121445-72160e2d5195 // indirect
@@ -25,4 +26,5 @@ require (
 	go.uber.org/zap v1.13.0 // indirect
 	golang.org/x/tools/gopls v0.1.3 // indirect
 	google.golang.org/grpc v1.26.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -44,6 +44,8 @@ func (s *Chaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return createData(stub, args)
 	case "UpdateData":
 		return updateData(stub, args)
+	case "GetData":
+		return getData(stub, args)
 	}
 	return shim.Error(fmt.Sprintf("Invoke cannot find function " + function))
 }
@@ -78,6 +80,13 @@ func updateData(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	return RespondSuccess(resSuc)
 }
 
+func getData(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	key1 := args[0]
+	key2 := args[1]
+
+	return util.GetDataByRowKeys(stub, []string{key1, key2}, new(Data), DATATABLE)
+}
+
 // The main function is only relevant in unit test mode. Only included here for completeness.
 func main() {
 	// Create a new Chain code
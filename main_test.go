@@ -1,12 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/Akachain/akc-go-sdk/common"
 	"github.com/Akachain/akc-go-sdk/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric/protos/utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -156,3 +172,733 @@ func TestGetQueryResultWithPagination(t *testing.T) {
 	json.Unmarshal(v.Value, &dat)
 	assert.Equal(t, dat.Key2, "5")
 }
+
+// transientChaincode echoes a transient field and checks that the recorded proposal does not carry it
+type transientChaincode struct {
+	Chaincode
+}
+
+func (s *transientChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	sp, err := stub.GetSignedProposal()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	prop, err := utils.GetProposal(sp.ProposalBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	cpp, err := utils.GetChaincodeProposalPayload(prop.Payload)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(cpp.TransientMap) != 0 {
+		return shim.Error("transient map leaked into the recorded proposal")
+	}
+	return shim.Success(transient["secret"])
+}
+
+// setupMemoryMock initializes a MockStubExtend that keeps the state in memory
+func setupMemoryMock(cc shim.Chaincode) *util.MockStubExtend {
+	return util.NewMockStubExtend(shim.NewMockStub("sample", cc), cc)
+}
+
+func TestTransient(t *testing.T) {
+	stub := setupMemoryMock(new(transientChaincode))
+
+	rs := util.MockInvokeTransactionWithTransient(t, stub, [][]byte{[]byte("Secret")}, map[string][]byte{"secret": []byte("s3cr3t")})
+	assert.Equal(t, "s3cr3t", rs)
+
+	// The transient map only lives for the duration of the transaction
+	transient, _ := stub.GetTransient()
+	assert.Nil(t, transient)
+
+	rs = util.MockInvokeTransaction(t, stub, [][]byte{[]byte("Secret")})
+	assert.Equal(t, "", rs)
+}
+
+// clockChaincode returns the transaction timestamp in RFC3339 format
+type clockChaincode struct {
+	Chaincode
+}
+
+func (s *clockChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	t, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(t.Format(time.RFC3339)))
+}
+
+func TestMockClock(t *testing.T) {
+	stub := setupMemoryMock(new(clockChaincode))
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	stub.Clock = util.NewMockClock(start)
+	args := [][]byte{[]byte("Now")}
+
+	// A fixed clock gives every transaction the same timestamp
+	assert.Equal(t, "2020-01-01T00:00:00Z", util.MockInvokeTransaction(t, stub, args))
+	assert.Equal(t, "2020-01-01T00:00:00Z", util.MockInvokeTransaction(t, stub, args))
+
+	stub.Clock.Advance(48 * time.Hour)
+	assert.Equal(t, "2020-01-03T00:00:00Z", util.MockInvokeTransaction(t, stub, args))
+
+	stub.Clock.SetStep(time.Minute)
+	assert.Equal(t, "2020-01-03T00:00:00Z", util.MockInvokeTransaction(t, stub, args))
+	assert.Equal(t, "2020-01-03T00:01:00Z", util.MockInvokeTransaction(t, stub, args))
+
+	stub.Clock.Script(start, start.Add(time.Hour))
+	assert.Equal(t, "2020-01-01T00:00:00Z", util.MockInvokeTransaction(t, stub, args))
+	assert.Equal(t, "2020-01-01T01:00:00Z", util.MockInvokeTransaction(t, stub, args))
+	assert.Equal(t, "2020-01-01T01:01:00Z", util.MockInvokeTransaction(t, stub, args))
+}
+
+// sbeChaincode writes a key and optionally restricts it to the endorsement of a single org
+type sbeChaincode struct {
+	Chaincode
+}
+
+func (s *sbeChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	if err := stub.PutState(args[0], []byte(args[1])); err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) > 2 {
+		ep, _ := statebased.NewStateEP(nil)
+		ep.AddOrgs(statebased.RoleTypePeer, args[2])
+		policy, _ := ep.Policy()
+		if err := stub.SetStateValidationParameter(args[0], policy); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return shim.Success(nil)
+}
+
+func TestKeyLevelEndorsement(t *testing.T) {
+	stub := setupMemoryMock(new(sbeChaincode))
+
+	// The key has no key-level policy before the transaction
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("Put"), []byte("asset1"), []byte("v1"), []byte("Org1MSP")})
+	assert.NoError(t, stub.ValidateKeyLevelEndorsement("Org2MSP"))
+
+	ep, _ := stub.GetStateValidationParameter("asset1")
+	assert.NotNil(t, ep)
+
+	// From now on, only Org1 can endorse changes to the key
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("Put"), []byte("asset1"), []byte("v2")})
+	assert.Error(t, stub.ValidateKeyLevelEndorsement("Org2MSP"))
+	assert.NoError(t, stub.ValidateKeyLevelEndorsement("Org1MSP", "Org2MSP"))
+
+	// Deleting the key drops its policy
+	stub.MockTransactionStart("del")
+	stub.DelState("asset1")
+	stub.MockTransactionEnd("del")
+	ep, _ = stub.GetStateValidationParameter("asset1")
+	assert.Nil(t, ep)
+}
+
+// counterChaincode writes how many times it has been invoked, which differs from one peer to another
+type counterChaincode struct {
+	Chaincode
+	count int
+}
+
+func (s *counterChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	s.count++
+	stub.PutState("counter", []byte(strconv.Itoa(s.count)))
+	return shim.Success(nil)
+}
+
+// cachingChaincode keeps the values it reads in memory, so a peer that has seen a key does not read it again
+type cachingChaincode struct {
+	Chaincode
+	cache map[string][]byte
+}
+
+func (s *cachingChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	value, ok := s.cache[args[0]]
+	if !ok {
+		value, _ = stub.GetState(args[0])
+		s.cache[args[0]] = value
+	}
+	return shim.Success(value)
+}
+
+func TestMockNetwork(t *testing.T) {
+	network, err := util.NewMockNetwork("AND('Org1MSP.member','Org2MSP.member')",
+		func() shim.Chaincode { return new(Chaincode) }, "Org1MSP", "Org2MSP", "Org3MSP")
+	assert.NoError(t, err)
+	args := [][]byte{[]byte("CreateData"), []byte("key1"), []byte("key2"), []byte("val1"), []byte("val2")}
+	compositeKey, _ := network.Peers["Org1MSP"].CreateCompositeKey(DATATABLE, []string{"key1", "key2"})
+
+	// Org1 alone does not satisfy the policy so nothing is committed
+	_, err = network.MockInvoke("tx1", args, "Org1MSP")
+	assert.Error(t, err)
+	for _, peer := range network.Peers {
+		state, _ := peer.GetState(compositeKey)
+		assert.Nil(t, state)
+	}
+
+	// Org1 and Org2 endorse, every peer commits the data
+	res, err := network.MockInvoke("tx2", args, "Org1MSP", "Org2MSP")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), res.Status)
+	for _, peer := range network.Peers {
+		state, _ := peer.GetState(compositeKey)
+		assert.NotNil(t, state)
+	}
+
+	// The peers do not share the memory of the chaincode: once Org2 has counted alone,
+	// the counter differs from one peer to the other and the write sets do not match
+	network, _ = util.NewMockNetwork("OR('Org1MSP.member','Org2MSP.member')",
+		func() shim.Chaincode { return new(counterChaincode) }, "Org1MSP", "Org2MSP")
+	_, err = network.MockInvoke("tx3", [][]byte{[]byte("Count")}, "Org1MSP", "Org2MSP")
+	assert.NoError(t, err)
+	_, err = network.MockInvoke("tx4", [][]byte{[]byte("Count")}, "Org2MSP")
+	assert.NoError(t, err)
+	_, err = network.MockInvoke("tx5", [][]byte{[]byte("Count")}, "Org1MSP", "Org2MSP")
+	assert.Error(t, err)
+	state, _ := network.Peers["Org1MSP"].GetState("counter")
+	assert.Equal(t, "2", string(state))
+
+	// Same response and no writes, but only the peer that has not cached the key reads it
+	network, _ = util.NewMockNetwork("OR('Org1MSP.member','Org2MSP.member')",
+		func() shim.Chaincode { return &cachingChaincode{cache: make(map[string][]byte)} }, "Org1MSP", "Org2MSP")
+	_, err = network.MockInvoke("tx6", [][]byte{[]byte("Get"), []byte("key")}, "Org1MSP")
+	assert.NoError(t, err)
+	_, err = network.MockInvoke("tx7", [][]byte{[]byte("Get"), []byte("key")}, "Org1MSP", "Org2MSP")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "read sets")
+	}
+}
+
+// stampChaincode writes the TxID and the transaction timestamp of every invocation
+type stampChaincode struct {
+	Chaincode
+}
+
+func (s *stampChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	ts, _ := stub.GetTxTimestamp()
+	txTime, _ := ptypes.Timestamp(ts)
+	previous, _ := stub.GetState("stamp")
+	stub.PutState("stamp", []byte(stub.GetTxID()+"@"+txTime.UTC().Format(time.RFC3339Nano)))
+	key, _ := stub.CreateCompositeKey("Tx_", []string{stub.GetTxID()})
+	stub.PutState(key, []byte(strconv.FormatInt(ts.Seconds, 10)))
+	return shim.Success(previous)
+}
+
+// recordingT collects the failures reported by the non-determinism detector
+type recordingT struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func TestDetectNonDeterminism(t *testing.T) {
+	rt := &recordingT{TB: t}
+
+	// The sample chaincode is deterministic
+	stub := setupMemoryMock(new(Chaincode))
+	stub.DetectNonDeterminism(rt)
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("CreateData"), []byte("key1"), []byte("key2"), []byte("val1"), []byte("val2")})
+	assert.Empty(t, rt.failures)
+
+	// Both runs start from the same state, so CreateData does not fail on the second run
+	compositeKey, _ := stub.CreateCompositeKey(DATATABLE, []string{"key1", "key2"})
+	state, _ := stub.GetState(compositeKey)
+	assert.NotNil(t, state)
+
+	// The counter differs between the two runs
+	stub = setupMemoryMock(new(counterChaincode))
+	stub.DetectNonDeterminism(rt)
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("Count")})
+	assert.Len(t, rt.failures, 1)
+	assert.Contains(t, rt.failures[0], "counter")
+
+	// Using the TxID and the timestamp is deterministic, and the probe run leaves
+	// the same key versions as a single run
+	rt.failures = nil
+	stub = setupMemoryMock(new(stampChaincode))
+	stub.DetectNonDeterminism(rt)
+	plain := setupMemoryMock(new(stampChaincode))
+	for _, s := range []*util.MockStubExtend{stub, plain} {
+		s.Clock = util.NewMockClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		s.MockInvoke("tx1", [][]byte{[]byte("Stamp")})
+		s.MockInvoke("tx2", [][]byte{[]byte("Stamp")})
+	}
+	assert.Empty(t, rt.failures)
+	stamp, _ := stub.GetState("stamp")
+	assert.Equal(t, "tx2@2020-01-01T00:00:00Z", string(stamp))
+	assert.Equal(t, plain.LastTxRWSet().Diff(), stub.LastTxRWSet().Diff())
+
+	// Both runs get the same injected faults
+	assert.NoError(t, stub.InjectFault(&util.MockFault{Operation: util.OpGetState, Pattern: "stamp", Nth: 1, Err: util.ErrMockTimeout}))
+	res := stub.MockInvoke("tx3", [][]byte{[]byte("Stamp")})
+	assert.Empty(t, rt.failures)
+	assert.Equal(t, int32(shim.OK), res.Status)
+	assert.Empty(t, res.Payload, "the GetState of the second run must fail too")
+}
+
+func TestLastTxRWSet(t *testing.T) {
+	stub := setupMemoryMock(new(Chaincode))
+	compositeKey, _ := stub.CreateCompositeKey(DATATABLE, []string{"key1", "key2"})
+
+	// CreateData checks that the row does not exist before writing it
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("CreateData"), []byte("key1"), []byte("key2"), []byte("val1"), []byte("val2")})
+	rwset := stub.LastTxRWSet()
+	assert.Equal(t, []string{compositeKey}, rwset.ReadKeys())
+	assert.Nil(t, rwset.PubRWSet.Reads[0].Version)
+	assert.Equal(t, []string{compositeKey}, rwset.WrittenKeys())
+
+	// GetData reads the row at the version written by CreateData and writes nothing
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("GetData"), []byte("key1"), []byte("key2")})
+	rwset = stub.LastTxRWSet()
+	assert.Equal(t, []string{compositeKey}, rwset.ReadKeys())
+	assert.Equal(t, uint64(1), rwset.PubRWSet.Reads[0].Version.BlockNum)
+	assert.Empty(t, rwset.WrittenKeys())
+
+	// UpdateData overwrites the row without reading it
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("UpdateData"), []byte("key1"), []byte("key2"), []byte("val3"), []byte("val4")})
+	rwset = stub.LastTxRWSet()
+	assert.Empty(t, rwset.ReadKeys())
+	assert.Equal(t, []string{compositeKey}, rwset.WrittenKeys())
+	assert.Contains(t, rwset.Diff(), "write    Data_(key1,key2)")
+	assert.Contains(t, rwset.Diff(), `- {"Key1":"key1","Key2":"key2","Attribute1":"val1","Attribute2":"val2"}`)
+	assert.Contains(t, rwset.Diff(), `+ {"Key1":"key1","Key2":"key2","Attribute1":"val3","Attribute2":"val4"}`)
+}
+
+// scanChaincode goes through the rows of the data table: all of them, only the first one, or the first page of one row
+type scanChaincode struct {
+	Chaincode
+}
+
+func (s *scanChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	var iterator shim.StateQueryIteratorInterface
+	if args[0] == "page" {
+		iterator, _, _ = stub.GetStateByPartialCompositeKeyWithPagination(DATATABLE, nil, 1, "")
+	} else {
+		iterator, _ = stub.GetStateByPartialCompositeKey(DATATABLE, nil)
+	}
+	defer iterator.Close()
+	for iterator.HasNext() {
+		iterator.Next()
+		if args[0] == "first" {
+			break
+		}
+	}
+	return shim.Success(nil)
+}
+
+func TestLastTxRangeQuery(t *testing.T) {
+	stub := setupMemoryMock(new(scanChaincode))
+	stub.MockTransactionStart("init")
+	for _, key := range []string{"a", "b"} {
+		compositeKey, _ := stub.CreateCompositeKey(DATATABLE, []string{key})
+		stub.PutState(compositeKey, []byte("{}"))
+	}
+	stub.MockTransactionEnd("init")
+	first, _ := stub.CreateCompositeKey(DATATABLE, []string{"a"})
+
+	// Going through every row exhausts the query
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("Scan"), []byte("all")})
+	query := stub.LastTxRWSet().PubRWSet.RangeQueriesInfo[0]
+	assert.True(t, query.ItrExhausted)
+	assert.Len(t, query.GetRawReads().GetKvReads(), 2)
+
+	// Stopping early records the rows read so far and ends the query at the last one
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("Scan"), []byte("first")})
+	query = stub.LastTxRWSet().PubRWSet.RangeQueriesInfo[0]
+	assert.False(t, query.ItrExhausted)
+	assert.Len(t, query.GetRawReads().GetKvReads(), 1)
+	assert.Equal(t, first, query.EndKey)
+
+	// A page that is not the last one is never exhausted
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("Scan"), []byte("page")})
+	query = stub.LastTxRWSet().PubRWSet.RangeQueriesInfo[0]
+	assert.False(t, query.ItrExhausted)
+	assert.Len(t, query.GetRawReads().GetKvReads(), 1)
+}
+
+func TestMockQueryTransaction(t *testing.T) {
+	stub := setupMemoryMock(new(Chaincode))
+	compositeKey, _ := stub.CreateCompositeKey(DATATABLE, []string{"key1", "key2"})
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("CreateData"), []byte("key1"), []byte("key2"), []byte("val1"), []byte("val2")})
+
+	rs := util.MockQueryTransaction(t, stub, [][]byte{[]byte("GetData"), []byte("key1"), []byte("key2")})
+	var data Data
+	json.Unmarshal([]byte(rs), &data)
+	assert.Equal(t, "val1", data.Attribute1)
+
+	// Writes made during a query are reported and discarded
+	res := stub.MockQuery("query", [][]byte{[]byte("UpdateData"), []byte("key1"), []byte("key2"), []byte("val3"), []byte("val4")})
+	assert.Equal(t, int32(shim.OK), res.Status)
+	assert.True(t, stub.LastTxRWSet().HasWrites())
+	state, _ := stub.GetState(compositeKey)
+	json.Unmarshal(state, &data)
+	assert.Equal(t, "val1", data.Attribute1)
+}
+
+// proposalChaincode verifies the signature, channel header and binding of its proposal
+type proposalChaincode struct {
+	Chaincode
+}
+
+func (s *proposalChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	sp, _ := stub.GetSignedProposal()
+	prop, err := utils.GetProposal(sp.ProposalBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	header, _ := utils.GetHeader(prop.Header)
+	chdr, _ := utils.UnmarshalChannelHeader(header.ChannelHeader)
+	if chdr.TxId != stub.GetTxID() || chdr.ChannelId != stub.GetChannelID() {
+		return shim.Error("channel header does not match the transaction")
+	}
+
+	// Verify the proposal signature against the creator certificate
+	creator, _ := stub.GetCreator()
+	sid := new(msp.SerializedIdentity)
+	proto.Unmarshal(creator, sid)
+	block, _ := pem.Decode(sid.IdBytes)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := cert.CheckSignature(x509.ECDSAWithSHA256, sp.ProposalBytes, sp.Signature); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	binding, _ := stub.GetBinding()
+	expected, _ := utils.ComputeProposalBinding(prop)
+	if !bytes.Equal(binding, expected) {
+		return shim.Error("binding does not match the proposal")
+	}
+	return shim.Success([]byte(sid.Mspid + " " + cert.Subject.CommonName + " " + string(stub.GetDecorations()["peer"])))
+}
+
+// peerDecorator adds the name of the peer to the chaincode input
+type peerDecorator struct {
+	name string
+}
+
+func (d *peerDecorator) Decorate(proposal *pb.Proposal, input *pb.ChaincodeInput) *pb.ChaincodeInput {
+	input.Decorations["peer"] = []byte(d.name)
+	return input
+}
+
+func TestSignedProposal(t *testing.T) {
+	stub := setupMemoryMock(new(proposalChaincode))
+	creator, err := util.NewMockIdentity("Org1MSP", "user1")
+	assert.NoError(t, err)
+	stub.Creator = creator
+	stub.Decorators = append(stub.Decorators, &peerDecorator{name: "peer0"})
+
+	res := stub.MockInvoke("tx1", [][]byte{[]byte("Verify")})
+	assert.Equal(t, int32(shim.OK), res.Status, res.Message)
+	assert.Equal(t, "Org1MSP user1 peer0", string(res.Payload))
+	assert.Nil(t, stub.GetDecorations())
+
+	// An identity without private key, as read from a serialized creator, verifies but cannot sign
+	msg := []byte("message")
+	signature, err := creator.Sign(msg)
+	assert.NoError(t, err)
+	assert.True(t, creator.Verify(msg, signature))
+	public := &util.MockIdentity{MspID: creator.MspID, Certificate: creator.Certificate, CertPEM: creator.CertPEM}
+	assert.True(t, public.Verify(msg, signature))
+	assert.False(t, public.Verify([]byte("other message"), signature))
+	_, err = public.Sign(msg)
+	assert.Error(t, err)
+}
+
+func TestInjectFault(t *testing.T) {
+	stub := setupMemoryMock(new(Chaincode))
+	create := [][]byte{[]byte("CreateData"), []byte("k1"), []byte("k2"), []byte("a1"), []byte("a2")}
+	get := [][]byte{[]byte("GetData"), []byte("k1"), []byte("k2")}
+
+	// The database times out while the row is written
+	stub.InjectFault(&util.MockFault{Operation: util.OpPutState, Pattern: "Data_*", Err: util.ErrMockTimeout, Latency: 10 * time.Millisecond})
+	start := time.Now()
+	res := stub.MockInvoke("tx1", create)
+	assert.Equal(t, int32(shim.ERROR), res.Status)
+	assert.Contains(t, res.Message, "AKC0005")
+	assert.True(t, time.Since(start) >= 10*time.Millisecond)
+
+	stub.ClearFaults()
+	util.MockInvokeTransaction(t, stub, create)
+
+	// Only the 2nd read of the row fails
+	stub.InjectFault(&util.MockFault{Operation: util.OpGetState, Pattern: "Data_*", Nth: 2, Err: fmt.Errorf("disk failure")})
+	util.MockQueryTransaction(t, stub, get)
+	res = stub.MockInvoke("tx3", get)
+	assert.Equal(t, int32(shim.ERROR), res.Status)
+	assert.Contains(t, res.Message, "GetTableRow failed because stub.GetState")
+	assert.Contains(t, res.Message, "disk failure")
+	util.MockQueryTransaction(t, stub, get)
+
+	assert.Error(t, stub.InjectFault(&util.MockFault{Operation: util.OpGetState, Pattern: "[Data_"}))
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	stub := setupMemoryMock(new(Chaincode))
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("CreateData"), []byte("k1"), []byte("k2"), []byte("a1"), []byte("a2")})
+	stub.MockTransactionStart("pvt")
+	stub.PutPrivateData("collection", "secret", []byte("s1"))
+	stub.MockTransactionEnd("pvt")
+
+	id, err := stub.Snapshot()
+	assert.NoError(t, err)
+	key, _ := stub.CreateCompositeKey(DATATABLE, []string{"k1", "k2"})
+	base, _ := stub.GetState(key)
+
+	for _, scenario := range []string{"b1", "b2"} {
+		util.MockInvokeTransaction(t, stub, [][]byte{[]byte("UpdateData"), []byte("k1"), []byte("k2"), []byte(scenario), []byte("a2")})
+		util.MockInvokeTransaction(t, stub, [][]byte{[]byte("CreateData"), []byte("k3"), []byte(scenario), []byte("a1"), []byte("a2")})
+		stub.MockTransactionStart("pvt")
+		stub.DelPrivateData("collection", "secret")
+		stub.MockTransactionEnd("pvt")
+
+		history, err := stub.GetHistoryForKey(key)
+		assert.NoError(t, err)
+		count := 0
+		for history.HasNext() {
+			modification, _ := history.Next()
+			assert.False(t, modification.IsDelete)
+			count++
+		}
+		assert.Equal(t, 2, count)
+
+		assert.NoError(t, stub.Restore(id))
+		value, _ := stub.GetState(key)
+		assert.Equal(t, base, value)
+		assert.Equal(t, 1, stub.Keys.Len())
+		secret, _ := stub.GetPrivateData("collection", "secret")
+		assert.Equal(t, "s1", string(secret))
+		history, _ = stub.GetHistoryForKey(key)
+		modification, _ := history.Next()
+		assert.Equal(t, base, modification.Value)
+		assert.False(t, history.HasNext())
+	}
+
+	assert.Error(t, stub.Restore("unknown"))
+}
+
+func TestLoadFixtures(t *testing.T) {
+	stub := setupMemoryMock(new(Chaincode))
+	fixtures, err := util.LoadFixtures(stub, "testdata/fixtures")
+	assert.NoError(t, err)
+
+	first := fixtures.Get(DATATABLE, "first", "Key1")
+	assert.NotEmpty(t, first)
+	rs := util.MockQueryTransaction(t, stub, [][]byte{[]byte("GetData"), []byte(first), []byte("k2")})
+	data := new(Data)
+	json.Unmarshal([]byte(rs), data)
+	assert.Equal(t, "first row", data.Attribute1)
+	assert.Equal(t, "Data_0", data.Attribute2)
+
+	second := fixtures.Get(DATATABLE, "second", "Key1")
+	rs = util.MockQueryTransaction(t, stub, [][]byte{[]byte("GetData"), []byte(second), []byte(first)})
+	json.Unmarshal([]byte(rs), data)
+	assert.Equal(t, "second row", data.Attribute1)
+
+	// Loading the same rows twice fails and leaves the ledger untouched
+	_, err = util.LoadFixtures(stub, "testdata/fixtures/Data_.yaml")
+	assert.Error(t, err)
+	assert.Equal(t, 2, stub.Keys.Len())
+}
+
+// update makes go test -update rewrite the golden files
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+func TestGoldenState(t *testing.T) {
+	stub := setupMemoryMock(new(Chaincode))
+	fixtures, err := util.LoadFixtures(stub, "testdata/fixtures")
+	assert.NoError(t, err)
+	first := fixtures.Get(DATATABLE, "first", "Key1")
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("UpdateData"), []byte(first), []byte("k2"), []byte("updated"), []byte("a2")})
+	util.AssertGoldenState(t, stub, "testdata/golden/state.json", *update)
+
+	if *update {
+		return
+	}
+
+	// A change of the stored rows shows up as a diff against the golden file
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("CreateData"), []byte("k3"), []byte("k4"), []byte("a1"), []byte("a2")})
+	rt := &recordingT{TB: t}
+	util.AssertGoldenState(rt, stub, "testdata/golden/state.json", false)
+	assert.Len(t, rt.failures, 1)
+	assert.Contains(t, rt.failures[0], `+         "k3",`)
+}
+
+// renamedChaincode stores Attribute1 under another name, as a new build of the sample chaincode could
+type renamedChaincode struct {
+	Chaincode
+}
+
+func (s *renamedChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	if function != "CreateData" {
+		return s.Chaincode.Invoke(stub)
+	}
+	row := map[string]string{"Key1": args[0], "Key2": args[1], "Attr1": args[2], "Attribute2": args[3]}
+	if err := util.Createdata(stub, DATATABLE, []string{args[0], args[1]}, row); err != nil {
+		return shim.Error(err.Error())
+	}
+	return common.RespondSuccess(common.ResponseSuccess{ResCode: common.SUCCESS, Msg: common.ResCodeDict[common.SUCCESS], Payload: ""})
+}
+
+func TestRecordReplay(t *testing.T) {
+	stub := setupMemoryMock(new(Chaincode))
+	creator, _ := util.NewMockIdentity("Org1MSP", "user1")
+	stub.Creator = creator
+	recording := util.NewTxRecording()
+	stub.Record(recording)
+	util.MockInitTransaction(t, stub, [][]byte{})
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("CreateData"), []byte("k1"), []byte("k2"), []byte("a1"), []byte("a2")})
+	util.MockQueryTransaction(t, stub, [][]byte{[]byte("GetData"), []byte("k1"), []byte("k2")})
+	assert.Len(t, recording.Transactions, 3)
+
+	dir, err := ioutil.TempDir("", "recording")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recording.json")
+	assert.NoError(t, recording.Save(path))
+
+	// The same build replays without divergence
+	util.AssertReplay(t, setupMemoryMock(new(Chaincode)), path, nil)
+
+	// A build that changes the stored layout diverges on the write and on the query response
+	loaded, err := util.LoadTxRecording(path)
+	assert.NoError(t, err)
+	divergences, err := loaded.Replay(setupMemoryMock(new(renamedChaincode)), nil)
+	assert.NoError(t, err)
+	assert.Len(t, divergences, 2)
+	assert.Contains(t, divergences[0], "transaction 1 (invoke")
+	assert.Contains(t, divergences[0], "key Data_(k1,k2) was written")
+	assert.Contains(t, divergences[1], "transaction 2 (query")
+	assert.Contains(t, divergences[1], "response was 200")
+}
+
+// dataV2 is the row layout of upgradedChaincode
+type dataV2 struct {
+	Key1        string `json:"Key1"`
+	Key2        string `json:"Key2"`
+	Attributes  []string
+	MigratedFor string
+}
+
+// upgradedChaincode is a v2 of the sample chaincode that migrates the rows of v1 into a new table on upgrade
+type upgradedChaincode struct {
+	Chaincode
+}
+
+const DATATABLEV2 = "DataV2_"
+
+func (s *upgradedChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	args := stub.GetStringArgs()
+	if len(args) != 2 || args[0] != "upgrade" {
+		return shim.Error("expected upgrade args")
+	}
+	rows, err := util.GetTableRows(stub, DATATABLE, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for row := range rows {
+		old := new(Data)
+		json.Unmarshal(row, old)
+		migrated := &dataV2{Key1: old.Key1, Key2: old.Key2, Attributes: []string{old.Attribute1, old.Attribute2}, MigratedFor: args[1]}
+		if _, err := util.InsertTableRow(stub, DATATABLEV2, []string{old.Key1, old.Key2}, migrated, util.FAIL_BEFORE_OVERWRITE, nil); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if args[1] == "fail" {
+		return shim.Error("migration failed after writing")
+	}
+	return shim.Success(nil)
+}
+
+func (s *upgradedChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	row := new(dataV2)
+	if _, err := util.GetTableRow(stub, DATATABLEV2, args, row, util.FAIL_IF_MISSING); err != nil {
+		return shim.Error(err.Error())
+	}
+	bytes, _ := json.Marshal(row)
+	return shim.Success(bytes)
+}
+
+func TestMockUpgrade(t *testing.T) {
+	stub := setupMemoryMock(new(Chaincode))
+	stub.Clock = util.NewMockClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	recording := util.NewTxRecording()
+	stub.Record(recording)
+	util.MockInitTransaction(t, stub, [][]byte{})
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("CreateData"), []byte("k1"), []byte("k2"), []byte("a1"), []byte("a2")})
+
+	// A failed upgrade keeps v1 and discards what Init wrote
+	res := stub.MockUpgrade("upgrade1", "v2", new(upgradedChaincode), [][]byte{[]byte("upgrade"), []byte("fail")})
+	assert.Equal(t, int32(shim.ERROR), res.Status)
+	rs := util.MockQueryTransaction(t, stub, [][]byte{[]byte("GetData"), []byte("k1"), []byte("k2")})
+	assert.Contains(t, rs, "a1")
+	failed, err := ptypes.Timestamp(recording.Transactions[2].Timestamp)
+	assert.NoError(t, err)
+	assert.Equal(t, 2020, failed.Year(), "the failed upgrade is recorded with its transaction timestamp")
+
+	res = stub.MockUpgrade("upgrade2", "v2", new(upgradedChaincode), [][]byte{[]byte("upgrade"), []byte("v2")})
+	assert.Equal(t, int32(shim.OK), res.Status, res.Message)
+	rs = util.MockQueryTransaction(t, stub, [][]byte{[]byte("GetData"), []byte("k1"), []byte("k2")})
+	row := new(dataV2)
+	assert.NoError(t, json.Unmarshal([]byte(rs), row))
+	assert.Equal(t, []string{"a1", "a2"}, row.Attributes)
+	assert.Equal(t, "v2", row.MigratedFor)
+
+	// The upgrades are recorded with the version of their chaincode and replayed with it
+	assert.Equal(t, util.RecordedUpgrade, recording.Transactions[2].Kind)
+	assert.Equal(t, "v2", recording.Transactions[2].Chaincode)
+	divergences, err := recording.Replay(setupMemoryMock(new(Chaincode)), map[string]shim.Chaincode{"v2": new(upgradedChaincode)})
+	assert.NoError(t, err)
+	assert.Empty(t, divergences)
+	_, err = recording.Replay(setupMemoryMock(new(Chaincode)), nil)
+	assert.Error(t, err)
+}
+
+func TestTxBudget(t *testing.T) {
+	stub := setupMemoryMock(new(Chaincode))
+	util.MockInvokeTransaction(t, stub, [][]byte{[]byte("CreateData"), []byte("k1"), []byte("k2"), []byte("a1"), []byte("a2")})
+
+	// InsertTableRow reads the row before writing it
+	cost := stub.LastTxCost()
+	assert.Equal(t, 1, cost.GetState)
+	assert.Equal(t, 1, cost.PutState)
+	assert.Equal(t, 0, cost.BytesRead)
+	assert.True(t, cost.BytesWritten > 0)
+	util.AssertTxBudget(t, stub, util.TxBudget{"GetState": 2, "PutState": 1})
+
+	rt := &recordingT{TB: t}
+	util.AssertTxBudget(rt, stub, util.TxBudget{"GetState": 0, "PutState": 1})
+	assert.Len(t, rt.failures, 1)
+	assert.Contains(t, rt.failures[0], "GetState is 1, budget is 0")
+
+	_, err := cost.Exceeds(util.TxBudget{"Reads": 1})
+	assert.Error(t, err)
+
+	util.MockQueryTransaction(t, stub, [][]byte{[]byte("GetData"), []byte("k1"), []byte("k2")})
+	assert.Equal(t, cost.BytesWritten, stub.LastTxCost().BytesRead)
+
+	// Range scans count the rows they return
+	stub.MockUpgrade("upgrade", "v2", new(upgradedChaincode), [][]byte{[]byte("upgrade"), []byte("v2")})
+	cost = stub.LastTxCost()
+	assert.Equal(t, 1, cost.RangeScans)
+	assert.Equal(t, 1, cost.RangeScanResults)
+}
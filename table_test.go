@@ -0,0 +1,722 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Akachain/akc-go-sdk/common"
+	"github.com/Akachain/akc-go-sdk/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/stretchr/testify/assert"
+)
+
+// asset declares its table with struct tags, its keys are in another order than its fields
+type asset struct {
+	_     struct{} `akc:"table,Asset_"`
+	Owner string   `json:"Owner" akc:"key,2"`
+	ID    string   `json:"ID" akc:"key,1"`
+	Value int      `json:"Value"`
+}
+
+// runInTx runs f as the body of a mock transaction
+func runInTx(stub *util.MockStubExtend, f func(stub shim.ChaincodeStubInterface) error) error {
+	stub.MockTransactionStart("tx")
+	defer stub.MockTransactionEnd("tx")
+	return f(stub)
+}
+
+func TestTable(t *testing.T) {
+	defer util.ResetTableDefinitions()
+	stub := setupMemoryMock(new(Chaincode))
+	assets, err := util.NewTable(new(asset))
+	assert.NoError(t, err)
+	assert.Equal(t, "Asset_", assets.Name)
+	assert.Equal(t, []string{"ID", "Owner"}, assets.Keys)
+
+	err = runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, assets.Insert(stub, &asset{ID: "a1", Owner: "alice", Value: 1}))
+		assert.NoError(t, assets.Insert(stub, &asset{ID: "a1", Owner: "bob", Value: 2}))
+		assert.NoError(t, assets.Insert(stub, &asset{ID: "a2", Owner: "alice", Value: 3}))
+		return assets.Insert(stub, &asset{ID: "a1", Owner: "alice"})
+	})
+	assert.Error(t, err)
+
+	// The composite key is the one InsertTableRow builds from the keys in order
+	row := new(asset)
+	found, _ := util.GetTableRow(stub, "Asset_", []string{"a1", "bob"}, row, util.FAIL_IF_MISSING)
+	assert.True(t, found)
+	assert.Equal(t, 2, row.Value)
+
+	row = &asset{ID: "a2", Owner: "alice"}
+	assert.NoError(t, assets.Get(stub, row))
+	assert.Equal(t, 3, row.Value)
+
+	var list []asset
+	assert.NoError(t, assets.List(stub, &list, "a1"))
+	assert.Len(t, list, 2)
+	var all []*asset
+	assert.NoError(t, assets.List(stub, &all))
+	assert.Len(t, all, 3)
+
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, assets.Update(stub, &asset{ID: "a2", Owner: "alice", Value: 4}))
+		assert.Error(t, assets.Update(stub, &asset{ID: "a3", Owner: "alice"}))
+		assert.NoError(t, assets.Delete(stub, &asset{ID: "a1", Owner: "bob"}))
+		assert.Error(t, assets.Delete(stub, &asset{ID: "a1", Owner: "bob"}))
+		assert.Error(t, assets.Insert(stub, &asset{ID: "a4"}))
+		assert.Error(t, assets.Insert(stub, asset{ID: "a4", Owner: "alice"}))
+		return nil
+	})
+	assert.Error(t, assets.Get(stub, &asset{ID: "a1", Owner: "bob"}))
+
+	_, err = util.NewTable(struct {
+		Key string `akc:"key,2"`
+	}{})
+	assert.Error(t, err)
+}
+
+// car is indexed by color and by make and model
+type car struct {
+	_     struct{} `akc:"table,Car_"`
+	ID    string   `json:"id" akc:"key,1"`
+	Color string   `json:"color" akc:"index,byColor"`
+	Make  string   `json:"make" akc:"index,byModel,1"`
+	Model string   `json:"model" akc:"index,byModel,2"`
+}
+
+func TestTableIndex(t *testing.T) {
+	defer util.ResetTableDefinitions()
+	stub := setupMemoryMock(new(Chaincode))
+	cars, err := util.NewTable(new(car))
+	assert.NoError(t, err)
+
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, cars.Insert(stub, &car{ID: "c1", Color: "red", Make: "fiat", Model: "500"}))
+		assert.NoError(t, cars.Insert(stub, &car{ID: "c2", Color: "blue", Make: "fiat", Model: "panda"}))
+		assert.NoError(t, cars.Insert(stub, &car{ID: "c3", Color: "red", Make: "ford", Model: "ka"}))
+		return nil
+	})
+
+	var red []car
+	assert.NoError(t, cars.ListByIndex(stub, &red, "byColor", "red"))
+	assert.Len(t, red, 2)
+	keys, err := util.GetRowKeysByIndex(stub, "Car_", "byModel", "fiat")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"c1"}, {"c2"}}, keys)
+
+	// The index follows the updates and deletions made through the table functions
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, cars.Update(stub, &car{ID: "c1", Color: "blue", Make: "fiat", Model: "500"}))
+		_, err := util.DeleteTableRow(stub, "Car_", []string{"c3"}, nil, util.FAIL_IF_MISSING)
+		return err
+	})
+	assert.NoError(t, cars.ListByIndex(stub, &red, "byColor", "red"))
+	assert.Len(t, red, 0)
+	var blue []*car
+	assert.NoError(t, cars.ListByIndex(stub, &blue, "byColor", "blue"))
+	assert.Len(t, blue, 2)
+	assert.Equal(t, "c1", blue[0].ID)
+
+	// Indexes can also be declared on tables without a schema
+	assert.NoError(t, util.DeclareIndex("Note_", "byAuthor", "author"))
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		_, err := util.InsertTableRow(stub, "Note_", []string{"n1"}, map[string]string{"author": "alice"}, util.FAIL_BEFORE_OVERWRITE, nil)
+		assert.NoError(t, err)
+		return util.UpdateTableRow(stub, "Note_", []string{"n1"}, map[string]string{"author": "bob"})
+	})
+	rows, err := util.GetTableRowsByIndex(stub, "Note_", "byAuthor", "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`{"author":"bob"}`}, []string{string(rows[0])})
+	keys, _ = util.GetRowKeysByIndex(stub, "Note_", "byAuthor", "alice")
+	assert.Empty(t, keys)
+	assert.Error(t, util.DeclareIndex("Note_", "byAuthor", "title"))
+
+	// Rows written before an index is declared are indexed by IndexTableRows
+	util.ResetTableDefinitions()
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		_, err := util.InsertTableRow(stub, "Note_", []string{"n2"}, map[string]string{"author": "carol"}, util.FAIL_BEFORE_OVERWRITE, nil)
+		return err
+	})
+	_, err = util.GetRowKeysByIndex(stub, "Note_", "byAuthor", "carol")
+	assert.Error(t, err)
+	assert.NoError(t, util.DeclareIndex("Note_", "byAuthor", "author"))
+	keys, _ = util.GetRowKeysByIndex(stub, "Note_", "byAuthor", "carol")
+	assert.Empty(t, keys)
+	assert.NoError(t, runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		return util.IndexTableRows(stub, "Note_")
+	}))
+	keys, _ = util.GetRowKeysByIndex(stub, "Note_", "byAuthor", "carol")
+	assert.Equal(t, [][]string{{"n2"}}, keys)
+	keys, _ = util.GetRowKeysByIndex(stub, "Note_", "byAuthor", "bob")
+	assert.Equal(t, [][]string{{"n1"}}, keys)
+
+	// A table declared with conflicting rules declares nothing
+	_, err = util.NewTable(struct {
+		_      struct{} `akc:"table,Note_"`
+		ID     string   `akc:"key,1"`
+		Author string   `json:"author" akc:"index,byAuthor"`
+		Title  string   `json:"title" akc:"index,byTitle"`
+		Rev    int      `json:"rev" akc:"version"`
+	}{})
+	assert.NoError(t, err)
+	_, err = util.NewTable(struct {
+		_      struct{} `akc:"table,Note_"`
+		ID     string   `akc:"key,1"`
+		Author string   `json:"author" akc:"index,byWriter"`
+		Rev    int      `json:"revision" akc:"version"`
+	}{})
+	assert.Error(t, err)
+	_, err = util.GetRowKeysByIndex(stub, "Note_", "byWriter")
+	assert.Error(t, err)
+}
+
+type account struct {
+	_      struct{} `akc:"table,Account_"`
+	ID     string   `json:"id" akc:"key,1"`
+	Email  string   `json:"email" akc:"unique,byEmail"`
+	Bank   string   `json:"bank" akc:"unique,byIBAN,1"`
+	Number string   `json:"number" akc:"unique,byIBAN,2"`
+}
+
+func TestTableUniqueConstraint(t *testing.T) {
+	defer util.ResetTableDefinitions()
+	stub := setupMemoryMock(new(Chaincode))
+	accounts, err := util.NewTable(new(account))
+	assert.NoError(t, err)
+
+	err = runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, accounts.Insert(stub, &account{ID: "a1", Email: "alice@example.com", Bank: "b1", Number: "1"}))
+		assert.NoError(t, accounts.Insert(stub, &account{ID: "a2", Email: "bob@example.com", Bank: "b1", Number: "2"}))
+		return accounts.Insert(stub, &account{ID: "a3", Email: "alice@example.com", Bank: "b2", Number: "1"})
+	})
+	var violation *util.UniqueViolationError
+	assert.True(t, errors.As(err, &violation))
+	assert.Equal(t, "byEmail", violation.Constraint)
+	assert.Equal(t, []string{"a1"}, violation.RowKeys)
+	assert.Equal(t, common.ERR19, util.ErrorCode(err, common.ERR5))
+	res := util.RespondTableError(err, common.ERR5)
+	assert.Contains(t, res.Message, common.ERR19)
+
+	// A row can keep its own values, but not take the values of another row
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, accounts.Update(stub, &account{ID: "a1", Email: "alice@example.com", Bank: "b1", Number: "1"}))
+		err := accounts.Update(stub, &account{ID: "a1", Email: "alice@example.com", Bank: "b1", Number: "2"})
+		assert.Equal(t, common.ERR19, util.ErrorCode(err, common.ERR5))
+		assert.True(t, strings.Contains(err.Error(), "byIBAN"))
+		return nil
+	})
+
+	// Deleting or changing a row releases its values
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, accounts.Update(stub, &account{ID: "a2", Email: "bob@example.org", Bank: "b1", Number: "2"}))
+		assert.NoError(t, accounts.Delete(stub, &account{ID: "a1"}))
+		assert.NoError(t, accounts.Insert(stub, &account{ID: "a3", Email: "bob@example.com", Bank: "b1", Number: "1"}))
+		return nil
+	})
+	keys, err := util.GetRowKeysByIndex(stub, "Account_", "byEmail", "bob@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"a3"}}, keys)
+	assert.Error(t, util.DeclareIndex("Account_", "byEmail", "email"))
+
+	// The string "1" and the number 1 are different values
+	assert.NoError(t, util.DeclareUniqueConstraint("Code_", "byCode", "code"))
+	err = runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		if _, err := util.InsertTableRow(stub, "Code_", []string{"c1"}, map[string]interface{}{"code": "1"}, util.FAIL_BEFORE_OVERWRITE, nil); err != nil {
+			return err
+		}
+		_, err := util.InsertTableRow(stub, "Code_", []string{"c2"}, map[string]interface{}{"code": 1}, util.FAIL_BEFORE_OVERWRITE, nil)
+		return err
+	})
+	assert.NoError(t, err)
+	keys, err = util.GetRowKeysByIndex(stub, "Code_", "byCode", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"c2"}}, keys)
+	keys, err = util.GetRowKeysByIndex(stub, "Code_", "byCode", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"c1"}}, keys)
+}
+
+// peerStub reads the state committed before the transaction like a peer does, instead of its own writes
+type peerStub struct {
+	shim.ChaincodeStubInterface
+	mock   *util.MockStubExtend
+	writes map[string][]byte // value written by key, nil if the key was deleted
+}
+
+func newPeerStub(mock *util.MockStubExtend) *peerStub {
+	return &peerStub{ChaincodeStubInterface: mock, mock: mock, writes: make(map[string][]byte)}
+}
+
+func (stub *peerStub) PutState(key string, value []byte) error {
+	stub.writes[key] = value
+	return nil
+}
+
+func (stub *peerStub) DelState(key string) error {
+	stub.writes[key] = nil
+	return nil
+}
+
+// commit writes the buffered writes to the mock stub
+func (stub *peerStub) commit() error {
+	stub.mock.MockTransactionStart("commit")
+	defer stub.mock.MockTransactionEnd("commit")
+	for key, value := range stub.writes {
+		var err error
+		if value == nil {
+			err = stub.mock.DelState(key)
+		} else {
+			err = stub.mock.PutState(key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	stub.writes = make(map[string][]byte)
+	return nil
+}
+
+func TestTableCommittedState(t *testing.T) {
+	defer util.ResetTableDefinitions()
+	mock := setupMemoryMock(new(Chaincode))
+	peer := newPeerStub(mock)
+	accounts, err := util.NewTable(new(account))
+	assert.NoError(t, err)
+
+	// Two rows of the same transaction cannot take the same unique values
+	mock.MockTransactionStart("tx1")
+	stub := util.NewTableTxStub(peer)
+	assert.NoError(t, accounts.Insert(stub, &account{ID: "a1", Email: "alice@example.com", Bank: "b1", Number: "1"}))
+	err = accounts.Insert(stub, &account{ID: "a2", Email: "alice@example.com", Bank: "b1", Number: "2"})
+	assert.Equal(t, common.ERR19, util.ErrorCode(err, common.ERR5))
+	err = accounts.Insert(stub, &account{ID: "a1", Email: "bob@example.com", Bank: "b1", Number: "3"})
+	assert.Error(t, err)
+
+	// A row updated twice keeps the index entries of its last value only
+	assert.NoError(t, accounts.Update(stub, &account{ID: "a1", Email: "alice@example.org", Bank: "b1", Number: "1"}))
+	assert.NoError(t, accounts.Update(stub, &account{ID: "a1", Email: "alice@example.net", Bank: "b1", Number: "1"}))
+	mock.MockTransactionEnd("tx1")
+	assert.NoError(t, peer.commit())
+
+	for email, expected := range map[string][][]string{
+		"alice@example.com": {},
+		"alice@example.org": {},
+		"alice@example.net": {{"a1"}},
+	} {
+		keys, err := util.GetRowKeysByIndex(mock, "Account_", "byEmail", email)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, keys, email)
+	}
+
+	// The next transaction starts with a new wrapper, and without one the writes of the transaction are not seen
+	mock.MockTransactionStart("tx2")
+	assert.NoError(t, accounts.Insert(util.NewTableTxStub(peer), &account{ID: "a2", Email: "bob@example.com", Bank: "b2", Number: "1"}))
+	assert.NoError(t, accounts.Insert(peer, &account{ID: "a3", Email: "bob@example.com", Bank: "b3", Number: "1"}))
+	mock.MockTransactionEnd("tx2")
+}
+
+type member struct {
+	_      struct{} `akc:"table,Member_"`
+	ID     string   `json:"id" akc:"key,1"`
+	Email  string   `json:"email" akc:"required;pattern,^[^@]+@[^@]+$;maxlen,32"`
+	Age    int      `json:"age" akc:"min,18;max,150"`
+	Status string   `json:"status" akc:"enum,active|closed"`
+}
+
+func TestTableSchema(t *testing.T) {
+	defer util.ResetTableDefinitions()
+	stub := setupMemoryMock(new(Chaincode))
+	members, err := util.NewTable(new(member))
+	assert.NoError(t, err)
+
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, members.Insert(stub, &member{ID: "m1", Email: "alice@example.com", Age: 30, Status: "active"}))
+		err := members.Insert(stub, &member{ID: "m2", Email: "bob", Age: 12, Status: "banned"})
+		var invalid *util.SchemaViolationError
+		assert.True(t, errors.As(err, &invalid))
+		assert.Equal(t, []string{"age", "email", "status"}, violatedFields(invalid))
+		assert.Equal(t, common.ERR20, util.ErrorCode(err, common.ERR5))
+
+		// Updates are validated too
+		err = members.Update(stub, &member{ID: "m1", Age: 30, Status: "closed"})
+		assert.True(t, errors.As(err, &invalid))
+		assert.Equal(t, "required", invalid.Violations[0].Rule)
+		return nil
+	})
+	assert.Nil(t, stub.State[mustCompositeKey(t, stub, "Member_", "m2")])
+
+	// Tables without struct tags can declare a JSON Schema
+	assert.NoError(t, util.DeclareJSONSchema("Profile_", []byte(`{
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string", "minLength": 2},
+			"score": {"type": "integer", "enum": [1, 2, 3]}
+		}
+	}`)))
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		err := util.UpdateTableRow(stub, "Profile_", []string{"p1"}, map[string]interface{}{"name": "al", "score": 2})
+		assert.NoError(t, err)
+		err = util.UpdateTableRow(stub, "Profile_", []string{"p1"}, map[string]interface{}{"name": "a", "score": 2.5})
+		var invalid *util.SchemaViolationError
+		assert.True(t, errors.As(err, &invalid))
+		assert.Equal(t, []util.FieldViolation{
+			{Field: "name", Rule: "minLength", Message: "must have a length of at least 2"},
+			{Field: "score", Rule: "type", Message: "must be of type integer"},
+		}, invalid.Violations)
+		return nil
+	})
+}
+
+func violatedFields(err *util.SchemaViolationError) []string {
+	fields := make([]string, 0)
+	for _, v := range err.Violations {
+		fields = append(fields, v.Field)
+	}
+	return fields
+}
+
+func mustCompositeKey(t *testing.T, stub shim.ChaincodeStubInterface, table string, keys ...string) string {
+	key, err := stub.CreateCompositeKey(table, keys)
+	assert.NoError(t, err)
+	return key
+}
+
+type stock struct {
+	_        struct{} `akc:"table,Stock_"`
+	Item     string   `json:"item" akc:"key,1"`
+	Quantity int      `json:"quantity"`
+	Version  int64    `json:"version" akc:"version"`
+}
+
+func TestTableVersion(t *testing.T) {
+	defer util.ResetTableDefinitions()
+	stub := setupMemoryMock(new(Chaincode))
+	stocks, err := util.NewTable(new(stock))
+	assert.NoError(t, err)
+
+	s := &stock{Item: "apple", Quantity: 10}
+	assert.NoError(t, runInTx(stub, func(stub shim.ChaincodeStubInterface) error { return stocks.Insert(stub, s) }))
+	assert.Equal(t, int64(1), s.Version)
+
+	// Two clients read the row, the first update wins and the second one is detected
+	first, second := &stock{Item: "apple"}, &stock{Item: "apple"}
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, stocks.Get(stub, first))
+		return stocks.Get(stub, second)
+	})
+	first.Quantity, second.Quantity = 9, 8
+	assert.NoError(t, runInTx(stub, func(stub shim.ChaincodeStubInterface) error { return stocks.Update(stub, first) }))
+	assert.Equal(t, int64(2), first.Version)
+	err = runInTx(stub, func(stub shim.ChaincodeStubInterface) error { return stocks.Update(stub, second) })
+	var conflict *util.VersionConflictError
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, int64(1), conflict.Expected)
+	assert.Equal(t, int64(2), conflict.Actual)
+	assert.Equal(t, common.ERR21, util.ErrorCode(err, common.ERR5))
+
+	// The conditional update takes the expected version from the caller
+	err = runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.Error(t, util.UpdateTableRowIfVersion(stub, "Stock_", []string{"apple"}, map[string]int{"quantity": 7}, 1))
+		return util.UpdateTableRowIfVersion(stub, "Stock_", []string{"apple"}, map[string]int{"quantity": 7}, 2)
+	})
+	assert.NoError(t, err)
+	row, _ := stub.GetState(mustCompositeKey(t, stub, "Stock_", "apple"))
+	assert.Equal(t, `{"quantity":7,"version":3}`, string(row))
+	version, err := util.GetRowVersion("Stock_", row)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), version)
+
+	// A new row must not carry a version
+	err = runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		return stocks.Insert(stub, &stock{Item: "pear", Version: 4})
+	})
+	assert.Equal(t, common.ERR21, util.ErrorCode(err, common.ERR5))
+}
+
+type invoice struct {
+	_      struct{} `akc:"table,Invoice_;softdelete"`
+	ID     string   `json:"id" akc:"key,1"`
+	Number string   `json:"number" akc:"unique,byNumber"`
+}
+
+func TestTableSoftDelete(t *testing.T) {
+	defer util.ResetTableDefinitions()
+	stub := setupMemoryMock(new(Chaincode))
+	invoices, err := util.NewTable(new(invoice))
+	assert.NoError(t, err)
+
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, invoices.Insert(stub, &invoice{ID: "i1", Number: "2020-001"}))
+		assert.NoError(t, invoices.Insert(stub, &invoice{ID: "i2", Number: "2020-002"}))
+		return nil
+	})
+	stub.MockTransactionStart("delete")
+	assert.NoError(t, invoices.Delete(stub, &invoice{ID: "i1"}))
+	stub.MockTransactionEnd("delete")
+
+	// The row is kept with a tombstone but hidden from reads and indexes
+	assert.NotNil(t, stub.State[mustCompositeKey(t, stub, "Invoice_", "i1")])
+	found, err := util.GetTableRow(stub, "Invoice_", []string{"i1"}, nil, util.DONT_FAIL_IF_MISSING)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	var listed []invoice
+	assert.NoError(t, invoices.List(stub, &listed))
+	assert.Equal(t, []invoice{{ID: "i2", Number: "2020-002"}}, listed)
+	keys, _ := util.GetRowKeysByIndex(stub, "Invoice_", "byNumber", "2020-001")
+	assert.Empty(t, keys)
+
+	deleted, err := util.ListDeletedTableRows(stub, "Invoice_", nil)
+	assert.NoError(t, err)
+	assert.Len(t, deleted, 1)
+	assert.Equal(t, []string{"i1"}, deleted[0].RowKeys)
+	assert.Equal(t, `{"id":"i1","number":"2020-001"}`, string(deleted[0].Value))
+	assert.Equal(t, "delete", deleted[0].Tombstone.TxID)
+	assert.NotEmpty(t, deleted[0].Tombstone.Timestamp)
+
+	// A restored row gets its index entries back, unless its unique values were taken in the meantime
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, invoices.Restore(stub, &invoice{ID: "i1"}))
+		assert.Error(t, invoices.Restore(stub, &invoice{ID: "i2"}))
+		assert.NoError(t, invoices.Delete(stub, &invoice{ID: "i1"}))
+		assert.NoError(t, invoices.Insert(stub, &invoice{ID: "i3", Number: "2020-001"}))
+		err := invoices.Restore(stub, &invoice{ID: "i1"})
+		assert.Equal(t, common.ERR19, util.ErrorCode(err, common.ERR5))
+		return nil
+	})
+	keys, _ = util.GetRowKeysByIndex(stub, "Invoice_", "byNumber", "2020-001")
+	assert.Equal(t, [][]string{{"i3"}}, keys)
+
+	// Restoring a row is a write: its version and audit metadata are stamped
+	receipts, err := util.NewTable(new(receipt))
+	assert.NoError(t, err)
+	stub.Creator, err = util.NewMockIdentity("Org1MSP", "alice")
+	assert.NoError(t, err)
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.NoError(t, receipts.Insert(stub, &receipt{ID: "r1"}))
+		return receipts.Delete(stub, &receipt{ID: "r1"})
+	})
+	stub.MockTransactionStart("restore")
+	assert.NoError(t, receipts.Restore(stub, &receipt{ID: "r1"}))
+	stub.MockTransactionEnd("restore")
+	restored := &receipt{ID: "r1"}
+	assert.NoError(t, runInTx(stub, func(stub shim.ChaincodeStubInterface) error { return receipts.Get(stub, restored) }))
+	assert.Equal(t, 2, restored.Version)
+	assert.Equal(t, "restore", restored.Audit.TxID)
+	assert.Equal(t, "Org1MSP", restored.Audit.CreatedBy.MspID)
+
+	// Purging deletes the row for good
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.Error(t, invoices.Purge(stub, &invoice{ID: "i2"}))
+		return invoices.Purge(stub, &invoice{ID: "i1"})
+	})
+	assert.Nil(t, stub.State[mustCompositeKey(t, stub, "Invoice_", "i1")])
+}
+
+type receipt struct {
+	_       struct{}       `akc:"table,Receipt_;softdelete;audit"`
+	ID      string         `json:"id" akc:"key,1"`
+	Version int            `json:"version" akc:"version"`
+	Audit   *util.RowAudit `json:"~audit,omitempty"`
+}
+
+type contract struct {
+	_     struct{}       `akc:"table,Contract_;audit"`
+	ID    string         `json:"id" akc:"key,1"`
+	Terms string         `json:"terms"`
+	Audit *util.RowAudit `json:"~audit,omitempty"`
+}
+
+func TestTableAudit(t *testing.T) {
+	defer util.ResetTableDefinitions()
+	stub := setupMemoryMock(new(Chaincode))
+	contracts, err := util.NewTable(new(contract))
+	assert.NoError(t, err)
+	alice, err := util.NewMockIdentity("Org1MSP", "alice")
+	assert.NoError(t, err)
+	bob, err := util.NewMockIdentity("Org2MSP", "bob")
+	assert.NoError(t, err)
+
+	// Rows cannot be stamped without a creator
+	assert.Error(t, runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		return contracts.Insert(stub, &contract{ID: "c1"})
+	}))
+
+	stub.Creator = alice
+	stub.MockTransactionStart("create")
+	assert.NoError(t, contracts.Insert(stub, &contract{ID: "c1", Terms: "v1"}))
+	stub.MockTransactionEnd("create")
+	created := &contract{ID: "c1"}
+	assert.NoError(t, runInTx(stub, func(stub shim.ChaincodeStubInterface) error { return contracts.Get(stub, created) }))
+	assert.Equal(t, util.AuditIdentity{MspID: "Org1MSP", Subject: "CN=alice,O=Org1MSP"}, created.Audit.CreatedBy)
+	assert.Equal(t, created.Audit.CreatedBy, created.Audit.UpdatedBy)
+	assert.Equal(t, "create", created.Audit.TxID)
+
+	// Updates keep the creation and cannot forge the metadata
+	stub.Creator = bob
+	stub.MockTransactionStart("update")
+	created.Terms = "v2"
+	created.Audit.CreatedBy.MspID = "ForgedMSP"
+	assert.NoError(t, contracts.Update(stub, created))
+	stub.MockTransactionEnd("update")
+	row, _ := stub.GetState(mustCompositeKey(t, stub, "Contract_", "c1"))
+	audit, err := util.GetRowAudit(row)
+	assert.NoError(t, err)
+	assert.Equal(t, "Org1MSP", audit.CreatedBy.MspID)
+	assert.Equal(t, "Org2MSP", audit.UpdatedBy.MspID)
+	assert.Equal(t, "CN=bob,O=Org2MSP", audit.UpdatedBy.Subject)
+	assert.Equal(t, "update", audit.TxID)
+	assert.NotEmpty(t, audit.UpdatedAt)
+}
+
+func TestTableRowsBatch(t *testing.T) {
+	defer util.ResetTableDefinitions()
+	stub := setupMemoryMock(new(Chaincode))
+	assert.NoError(t, util.DeclareUniqueConstraint("Employee_", "byBadge", "badge"))
+	employee := func(id string, badge string) util.TableRow {
+		return util.TableRow{Keys: []string{id}, Value: map[string]string{"id": id, "badge": badge}}
+	}
+
+	err := runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		return util.InsertTableRows(stub, "Employee_", []util.TableRow{employee("e1", "b1"), employee("e2", "b2")}, util.FAIL_BEFORE_OVERWRITE)
+	})
+	assert.NoError(t, err)
+
+	// Every failing row is reported and nothing is written
+	err = runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		return util.InsertTableRows(stub, "Employee_", []util.TableRow{
+			employee("e3", "b3"),
+			employee("e1", "b9"),
+			employee("e4", "b3"),
+			employee("e3", "b8"),
+			employee("e5", "b2"),
+		}, util.FAIL_BEFORE_OVERWRITE)
+	})
+	var batch *util.BatchError
+	assert.True(t, errors.As(err, &batch))
+	assert.Equal(t, common.ERR22, util.ErrorCode(err, common.ERR5))
+	indexes := make([]int, 0)
+	for _, row := range batch.Rows {
+		indexes = append(indexes, row.Index)
+	}
+	assert.Equal(t, []int{1, 2, 3, 4}, indexes)
+	assert.Equal(t, common.ERR19, util.ErrorCode(batch.Rows[1], common.ERR5))
+	assert.Equal(t, common.ERR19, util.ErrorCode(batch.Rows[3], common.ERR5))
+	assert.Nil(t, stub.State[mustCompositeKey(t, stub, "Employee_", "e3")])
+
+	err = runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		return util.UpdateTableRows(stub, "Employee_", []util.TableRow{employee("e1", "b5"), employee("e9", "b6")})
+	})
+	assert.True(t, errors.As(err, &batch))
+	assert.Equal(t, []string{"e9"}, batch.Rows[0].RowKeys)
+	keys, _ := util.GetRowKeysByIndex(stub, "Employee_", "byBadge", "b1")
+	assert.Equal(t, [][]string{{"e1"}}, keys)
+
+	// A row can take the unique values that another row of the batch gives up, in any order
+	err = runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		return util.UpdateTableRows(stub, "Employee_", []util.TableRow{employee("e2", "b1"), employee("e1", "b2")})
+	})
+	assert.NoError(t, err)
+	keys, _ = util.GetRowKeysByIndex(stub, "Employee_", "byBadge", "b1")
+	assert.Equal(t, [][]string{{"e2"}}, keys)
+	keys, _ = util.GetRowKeysByIndex(stub, "Employee_", "byBadge", "b2")
+	assert.Equal(t, [][]string{{"e1"}}, keys)
+
+	// Deletions free the unique values of the rows
+	err = runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		assert.Error(t, util.DeleteTableRows(stub, "Employee_", [][]string{{"e1"}, {"e9"}}, util.FAIL_IF_MISSING))
+		return util.DeleteTableRows(stub, "Employee_", [][]string{{"e1"}, {"e9"}}, util.DONT_FAIL_IF_MISSING)
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, stub.State[mustCompositeKey(t, stub, "Employee_", "e1")])
+	keys, _ = util.GetRowKeysByIndex(stub, "Employee_", "byBadge")
+	assert.Equal(t, [][]string{{"e2"}}, keys)
+}
+
+func TestTableRowsWithPagination(t *testing.T) {
+	defer util.ResetTableDefinitions()
+	stub := setupMemoryMock(new(Chaincode))
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		for _, id := range []string{"p1", "p2", "p3", "p4", "p5"} {
+			_, err := util.InsertTableRow(stub, "Page_", []string{id}, map[string]string{"id": id}, util.FAIL_BEFORE_OVERWRITE, nil)
+			assert.NoError(t, err)
+		}
+		return nil
+	})
+
+	// The bookmark of a page is the key of the first row of the next page
+	ids := make([]string, 0)
+	bookmark := ""
+	for pages := 0; pages == 0 || bookmark != ""; pages++ {
+		assert.True(t, pages < 3)
+		page, err := util.GetTableRowsWithPagination(stub, "Page_", nil, 2, bookmark)
+		assert.NoError(t, err)
+		for _, row := range page.Rows {
+			ids = append(ids, string(row))
+		}
+		assert.Equal(t, int32(len(page.Rows)), page.FetchedRecordsCount)
+		bookmark = page.Bookmark
+	}
+	assert.Equal(t, []string{`{"id":"p1"}`, `{"id":"p2"}`, `{"id":"p3"}`, `{"id":"p4"}`, `{"id":"p5"}`}, ids)
+	_, err := util.GetTableRowsWithPagination(stub, "Page_", nil, 2, "p3")
+	assert.Error(t, err)
+
+	var payload struct {
+		Data     []map[string]string
+		Metadata util.PaginationMetadata
+	}
+	res := util.GetAllDataWithPagination(stub, new(map[string]string), "Page_", 4, "")
+	assert.Equal(t, int32(shim.OK), res.Status)
+	assert.NoError(t, json.Unmarshal(res.Payload, &payload))
+	assert.Len(t, payload.Data, 4)
+	assert.Equal(t, int32(4), payload.Metadata.FetchedRecordsCount)
+	assert.Equal(t, mustCompositeKey(t, stub, "Page_", "p5"), payload.Metadata.Bookmark)
+}
+
+func TestTableRowIterator(t *testing.T) {
+	defer util.ResetTableDefinitions()
+	stub := setupMemoryMock(new(Chaincode))
+	runInTx(stub, func(stub shim.ChaincodeStubInterface) error {
+		for _, id := range []string{"l1", "l2", "l3"} {
+			_, err := util.InsertTableRow(stub, "Line_", []string{id}, map[string]string{"id": id}, util.FAIL_BEFORE_OVERWRITE, nil)
+			assert.NoError(t, err)
+		}
+		return nil
+	})
+
+	// The iteration can stop early, the iterator is then closed
+	iterator, err := util.GetTableRowIterator(stub, "Line_", nil)
+	assert.NoError(t, err)
+	assert.True(t, iterator.Next())
+	assert.Equal(t, []string{"l1"}, iterator.RowKeys())
+	assert.Equal(t, `{"id":"l1"}`, string(iterator.Row()))
+	assert.NoError(t, iterator.Close())
+	assert.False(t, iterator.Next())
+	assert.NoError(t, iterator.Err())
+	assert.NoError(t, iterator.Close())
+
+	visited := 0
+	err = util.ForEachTableRow(stub, "Line_", nil, func(row []byte) error {
+		visited++
+		if visited == 2 {
+			return util.ErrStopIteration
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, visited)
+	err = util.ForEachTableRow(stub, "Line_", nil, func(row []byte) error { return fmt.Errorf("bad row %s", row) })
+	assert.EqualError(t, err, `bad row {"id":"l1"}`)
+
+	// Query errors are returned instead of panicking
+	res := util.GetAllData(stub, new(map[string]string), "Line_")
+	assert.Equal(t, `[{"id":"l1"},{"id":"l2"},{"id":"l3"}]`, string(res.Payload))
+	stub.InjectFault(&util.MockFault{Operation: util.OpGetStateByPartialCompositeKey, Err: fmt.Errorf("disk failure")})
+	_, err = util.GetTableRows(stub, "Line_", nil)
+	assert.Error(t, err)
+	res = util.GetAllData(stub, new(map[string]string), "Line_")
+	assert.Equal(t, int32(shim.ERROR), res.Status)
+	assert.Contains(t, res.Message, "disk failure")
+}
@@ -12,11 +12,18 @@ import (
 type AkcQueryIterator struct {
 	data       []*couchdb.QueryResult
 	currentLoc int
+	rangeQuery *rangeQueryRecord // range query of the read set that the iterator updates, nil if there is none
 	*StateQueryIterator
 }
 
 func (it *AkcQueryIterator) HasNext() bool {
-	return it.currentLoc < len(it.data)
+	if it.currentLoc < len(it.data) {
+		return true
+	}
+	if it.rangeQuery != nil {
+		it.rangeQuery.exhaust()
+	}
+	return false
 }
 
 func (it *AkcQueryIterator) Length() int {
@@ -37,7 +44,11 @@ func (it *AkcQueryIterator) Next() (*queryresult.KV, error) {
 		return nil, errors.New("empty query result")
 	}
 
+	kv.Key = item.ID
 	kv.Value = item.Value
+	if it.rangeQuery != nil {
+		it.rangeQuery.read(it.currentLoc-1, item.ID)
+	}
 
 	return kv, nil
 }
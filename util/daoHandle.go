@@ -69,6 +69,7 @@ func Getdatabyrowkeys(stub shim.ChaincodeStubInterface, rowKeys []string, MODELT
 }
 
 //get all data
+// The rows are read before Getalldata returns, use ForEachTableRow to read them one at a time.
 func Getalldata(stub shim.ChaincodeStubInterface, MODELTABLE string) (chan []byte, error) {
 	row_json_bytes, err := GetTableRows(stub, MODELTABLE, []string{})
 	if err != nil {
@@ -134,16 +135,17 @@ func GetAllData(stub shim.ChaincodeStubInterface, data interface{}, ModelTable s
 	// var Datalist []interface{}
 	var Datalist = make([]map[string]interface{}, 0)
 
-	datalbytes, err := Getalldata(stub, ModelTable)
+	iterator, err := GetTableRowIterator(stub, ModelTable, []string{})
 	if err != nil {
 		//Get Data Fail
 		resErr := common.ResponseError{common.ERR4, fmt.Sprintf("%s %s %s", common.ResCodeDict[common.ERR4], err.Error(), common.GetLine())}
 		return common.RespondError(resErr)
 	}
+	defer iterator.Close()
 
-	for row_json_bytes := range datalbytes {
+	for iterator.Next() {
 
-		err := json.Unmarshal(row_json_bytes, data)
+		err := json.Unmarshal(iterator.Row(), data)
 		if err != nil {
 			resErr := common.ResponseError{common.ERR3, common.ResCodeDict[common.ERR6]}
 			return common.RespondError(resErr)
@@ -165,11 +167,11 @@ func GetAllData(stub shim.ChaincodeStubInterface, data interface{}, ModelTable s
 		Datalist = append(Datalist, temp)
 	}
 
-	//if err != nil {
-	//	//Get data eror
-	//	resErr := common.ResponseError{common.ERR3, common.ResCodeDict[common.ERR3]}
-	//	return common.RespondError(resErr)
-	//}
+	if err := iterator.Err(); err != nil {
+		//Get data eror
+		resErr := common.ResponseError{ResCode: common.ERR4, Msg: fmt.Sprintf("%s %s %s", common.ResCodeDict[common.ERR4], err.Error(), common.GetLine())}
+		return common.RespondError(resErr)
+	}
 
 	fmt.Printf("Datalist: %v\n", Datalist)
 	dataJson, err2 := json.Marshal(Datalist)
@@ -183,4 +185,63 @@ func GetAllData(stub shim.ChaincodeStubInterface, data interface{}, ModelTable s
 	return common.RespondSuccess(resSuc)
 }
 
+// PaginatedData is the payload of GetAllDataWithPagination
+type PaginatedData struct {
+	Data     []map[string]interface{} `json:"data"`
+	Metadata PaginationMetadata       `json:"metadata"`
+}
+
+// PaginationMetadata tells how to get the next page of GetAllDataWithPagination
+type PaginationMetadata struct {
+	FetchedRecordsCount int32  `json:"fetchedRecordsCount"`
+	Bookmark            string `json:"bookmark"` // empty on the last page
+}
+
+// GetAllDataWithPagination works similar to GetAllData but returns at most pageSize rows starting at bookmark,
+// along with the bookmark of the next page. See GetTableRowsWithPagination for its limits.
+func GetAllDataWithPagination(stub shim.ChaincodeStubInterface, data interface{}, ModelTable string, pageSize int32, bookmark string) pb.Response {
+	page, err := GetTableRowsWithPagination(stub, ModelTable, []string{}, pageSize, bookmark)
+	if err != nil {
+		//Get Data Fail
+		resErr := common.ResponseError{ResCode: common.ERR4, Msg: fmt.Sprintf("%s %s %s", common.ResCodeDict[common.ERR4], err.Error(), common.GetLine())}
+		return common.RespondError(resErr)
+	}
+
+	result := PaginatedData{
+		Data:     make([]map[string]interface{}, 0, len(page.Rows)),
+		Metadata: PaginationMetadata{FetchedRecordsCount: page.FetchedRecordsCount, Bookmark: page.Bookmark},
+	}
+	for _, row_json_bytes := range page.Rows {
+		err := json.Unmarshal(row_json_bytes, data)
+		if err != nil {
+			resErr := common.ResponseError{ResCode: common.ERR3, Msg: common.ResCodeDict[common.ERR6]}
+			return common.RespondError(resErr)
+		}
+
+		bytes, err := json.Marshal(data)
+		if err != nil {
+			//convert JSON eror
+			resErr := common.ResponseError{ResCode: common.ERR3, Msg: common.ResCodeDict[common.ERR6]}
+			return common.RespondError(resErr)
+		}
+
+		var temp map[string]interface{}
+		err = json.Unmarshal(bytes, &temp)
+		if err != nil {
+			resErr := common.ResponseError{ResCode: common.ERR3, Msg: common.ResCodeDict[common.ERR6]}
+			return common.RespondError(resErr)
+		}
+		result.Data = append(result.Data, temp)
+	}
+
+	dataJson, err := json.Marshal(result)
+	if err != nil {
+		//convert JSON eror
+		resErr := common.ResponseError{ResCode: common.ERR6, Msg: common.ResCodeDict[common.ERR6]}
+		return common.RespondError(resErr)
+	}
+	resSuc := common.ResponseSuccess{ResCode: common.SUCCESS, Msg: common.ResCodeDict[common.SUCCESS], Payload: string(dataJson)}
+	return common.RespondSuccess(resSuc)
+}
+
 // ------------------- //
@@ -1,12 +1,16 @@
 package util
 
 import (
-	"encoding/json"
+	"fmt"
+	"sort"
+
 	"github.com/hyperledger/fabric/common/metrics/disabled"
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb/statecouchdb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/storageutil"
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
 	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
 )
 
 const (
@@ -74,17 +78,73 @@ func NewCouchDBHandler(dbName string, isDrop bool) (*CouchDBHandler, error) {
 
 // SaveDocument stores a value in couchDB
 func (handler *CouchDBHandler) SaveDocument(key string, value []byte) error {
-	// unmarshal the value param
-	var doc map[string]interface{}
-	json.Unmarshal(value, &doc)
+	// Like the peer, keep the metadata of the key when only its value is updated
+	metadata, err := handler.readMetadata(key)
+	if err != nil {
+		return err
+	}
 
 	// Save the doc in database
+	return handler.saveDocument(key, value, metadata)
+}
+
+// DeleteDocument removes a document and its metadata from couchDB
+func (handler *CouchDBHandler) DeleteDocument(key string) error {
+	batch := statedb.NewUpdateBatch()
+	batch.Delete(DefaultChaincodeName, key, version.NewHeight(1, 1))
+	savePoint := version.NewHeight(1, 2)
+	return handler.dbEngine.ApplyUpdates(batch, savePoint)
+}
+
+// ReadDocumentMetadata returns the metadata entries stored next to a document
+func (handler *CouchDBHandler) ReadDocumentMetadata(id string) (map[string][]byte, error) {
+	metadata, err := handler.readMetadata(id)
+	if err != nil {
+		return nil, err
+	}
+	return storageutil.DeserializeMetadata(metadata)
+}
+
+// SaveDocumentMetadata replaces the metadata entries stored next to an existing document
+func (handler *CouchDBHandler) SaveDocumentMetadata(id string, entries map[string][]byte) error {
+	value, err := handler.ReadDocument(id)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return fmt.Errorf("cannot save metadata of document %s because it does not exist", id)
+	}
+
+	// Sort the entries so that the serialized metadata is deterministic
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metadataEntries := make([]*kvrwset.KVMetadataEntry, 0, len(entries))
+	for _, name := range names {
+		metadataEntries = append(metadataEntries, &kvrwset.KVMetadataEntry{Name: name, Value: entries[name]})
+	}
+	metadata, err := storageutil.SerializeMetadata(metadataEntries)
+	if err != nil {
+		return err
+	}
+	return handler.saveDocument(id, value, metadata)
+}
+
+func (handler *CouchDBHandler) saveDocument(key string, value []byte, metadata []byte) error {
 	batch := statedb.NewUpdateBatch()
-	batch.Put(DefaultChaincodeName, key, value, version.NewHeight(1, 1))
+	batch.PutValAndMetadata(DefaultChaincodeName, key, value, metadata, version.NewHeight(1, 1))
 	savePoint := version.NewHeight(1, 2)
-	err := handler.dbEngine.ApplyUpdates(batch, savePoint)
+	return handler.dbEngine.ApplyUpdates(batch, savePoint)
+}
 
-	return err
+func (handler *CouchDBHandler) readMetadata(id string) ([]byte, error) {
+	rs, er := handler.dbEngine.GetState(DefaultChaincodeName, id)
+	if er != nil || rs == nil {
+		return nil, er
+	}
+	return rs.Metadata, nil
 }
 
 // QueryDocument executes a query string and return results
@@ -125,17 +185,13 @@ func (handler *CouchDBHandler) QueryDocumentByRange(startKey, endKey string) (st
 	return rs, er
 }
 
-//// QueryDocumentByRange get a list of documents from couchDB by key range
-//// TODO: GetStateRangeScanIteratorWithMetadata does not accept bookmark
-//func (handler *CouchDBHandler) QueryDocumentByRangeWithPagination(startKey, endKey string, limit int32, bookmark string) (statedb.ResultsIterator, error) {
-//	queryOptions := make(map[string]interface{})
-//	if limit != 0 {
-//		queryOptions["limit"] = limit
-//	}
-//	//if bookmark != "" {
-//	//	queryOptions["bookmark"] = bookmark
-//	//}
-//
-//	rs, er := handler.dbEngine.GetStateRangeScanIteratorWithMetadata(DefaultChaincodeName, startKey, endKey, queryOptions)
-//	return rs, er
-//}
+// QueryDocumentByRangeWithLimit get at most limit documents from couchDB by key range, all of them if limit is 0.
+// GetStateRangeScanIteratorWithMetadata does not accept a bookmark, the next page starts at the key following the last one.
+func (handler *CouchDBHandler) QueryDocumentByRangeWithLimit(startKey, endKey string, limit int32) (statedb.ResultsIterator, error) {
+	queryOptions := make(map[string]interface{})
+	if limit != 0 {
+		queryOptions["limit"] = limit
+	}
+	rs, er := handler.dbEngine.GetStateRangeScanIteratorWithMetadata(DefaultChaincodeName, startKey, endKey, queryOptions)
+	return rs, er
+}
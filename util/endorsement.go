@@ -0,0 +1,104 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// ValidateKeyLevelEndorsement checks whether endorsements from the given orgs (MSP IDs) satisfy
+// the key-level endorsement policy of every key written by the last transaction.
+// Like on a committing peer, a key is validated against the policy it had before the transaction,
+// so a transaction that changes the policy of a key must satisfy the old one.
+// Keys without a key-level policy are left to the chaincode-level endorsement policy.
+func (stub *MockStubExtend) ValidateKeyLevelEndorsement(orgs ...string) error {
+	if stub.lastTx == nil {
+		return nil
+	}
+	return validateKeyLevelEndorsement(stub.lastTx.writes, orgs)
+}
+
+// validateKeyLevelEndorsement checks the written keys against the policies they had before the transaction
+func validateKeyLevelEndorsement(previous txWriteSet, orgs []string) error {
+	failedKeys := make([]string, 0)
+	for key, old := range previous {
+		if len(old.validationParameter) == 0 {
+			continue
+		}
+		policy := new(common.SignaturePolicyEnvelope)
+		if err := proto.Unmarshal(old.validationParameter, policy); err != nil {
+			return fmt.Errorf("invalid key-level endorsement policy for key %s: %v", key, err)
+		}
+		if !policySatisfied(policy, orgs) {
+			failedKeys = append(failedKeys, key)
+		}
+	}
+
+	if len(failedKeys) > 0 {
+		sort.Strings(failedKeys)
+		return fmt.Errorf("key-level endorsement policy of keys %q is not satisfied by orgs %v", failedKeys, orgs)
+	}
+	return nil
+}
+
+// policySatisfied evaluates a signature policy the same way cauthdsl does,
+// assuming each org endorses with exactly one peer identity.
+func policySatisfied(policy *common.SignaturePolicyEnvelope, orgs []string) bool {
+	// an org endorses only once however many times it is listed
+	endorsers := make([]string, 0, len(orgs))
+	seen := make(map[string]bool)
+	for _, org := range orgs {
+		if !seen[org] {
+			seen[org] = true
+			endorsers = append(endorsers, org)
+		}
+	}
+	return evaluateRule(policy.Rule, policy.Identities, endorsers, make([]bool, len(endorsers)))
+}
+
+// evaluateRule evaluates a rule of a signature policy, used marks the endorsers already consumed by other rules
+func evaluateRule(rule *common.SignaturePolicy, principals []*msp.MSPPrincipal, endorsers []string, used []bool) bool {
+	switch t := rule.GetType().(type) {
+	case *common.SignaturePolicy_NOutOf_:
+		verified := int32(0)
+		_used := make([]bool, len(used))
+		for _, subRule := range t.NOutOf.Rules {
+			copy(_used, used)
+			if evaluateRule(subRule, principals, endorsers, _used) {
+				verified++
+				copy(used, _used)
+			}
+		}
+		return verified >= t.NOutOf.N
+	case *common.SignaturePolicy_SignedBy:
+		if t.SignedBy < 0 || int(t.SignedBy) >= len(principals) {
+			return false
+		}
+		for i, org := range endorsers {
+			if !used[i] && orgSatisfiesPrincipal(org, principals[t.SignedBy]) {
+				used[i] = true
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// orgSatisfiesPrincipal tells whether a peer of org matches an MSP role principal
+func orgSatisfiesPrincipal(org string, principal *msp.MSPPrincipal) bool {
+	if principal.PrincipalClassification != msp.MSPPrincipal_ROLE {
+		return false
+	}
+	role := new(msp.MSPRole)
+	if err := proto.Unmarshal(principal.Principal, role); err != nil {
+		return false
+	}
+	if role.MspIdentifier != org {
+		return false
+	}
+	// Endorsements come from peers, which are both members and peers of their org
+	return role.Role == msp.MSPRole_MEMBER || role.Role == msp.MSPRole_PEER
+}
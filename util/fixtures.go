@@ -0,0 +1,294 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	. "github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fixtureNameField names a row so that other rows can reference it, it is not stored in the ledger
+const fixtureNameField = "_name"
+
+// Fixture is the content of a fixture file: rows of a table along with the fields that make their keys.
+//
+//	table: Data_
+//	keys: [Key1, Key2]
+//	rows:
+//	  - _name: first
+//	    Key1: "{{ id }}"
+//	    Key2: k2
+//	  - Key1: "{{ id }}"
+//	    Key2: '{{ ref "Data_" "first" "Key1" }}'
+//
+// String values are text/template templates that can use the functions
+// id (an ID derived from the table and the row), uuid (a random ID) and
+// ref table name field (a field of a row loaded before), and the fields .Table and .Index.
+type Fixture struct {
+	Table string                   `json:"table" yaml:"table"` // defaults to the name of the file without its extension
+	Keys  []string                 `json:"keys" yaml:"keys"`   // fields whose values are the row keys, in order
+	Rows  []map[string]interface{} `json:"rows" yaml:"rows"`
+}
+
+// Fixtures keeps the rows that were loaded, by table and by row name
+type Fixtures struct {
+	rows map[string]map[string]map[string]interface{}
+}
+
+// LoadFixtures seeds the ledger of stub with fixture files, in a single transaction.
+// A path can be a .yaml, .yml or .json file, or a directory whose fixture files are loaded in alphabetical order.
+// Rows are inserted with InsertTableRow so that their composite keys are the same as the chaincode's.
+func LoadFixtures(stub *MockStubExtend, paths ...string) (*Fixtures, error) {
+	files, err := fixtureFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	fixtures := &Fixtures{rows: make(map[string]map[string]map[string]interface{})}
+	var loadErr error
+	res := stub.mockTransaction(genTxID(), nil, nil, stub.nextTxTimestamp(), func(s ChaincodeStubInterface) pb.Response {
+		for _, file := range files {
+			if loadErr = fixtures.load(s, file); loadErr != nil {
+				return Error(loadErr.Error())
+			}
+		}
+		return Success(nil)
+	})
+	if res.Status != OK {
+		if err := stub.rollbackLastTransaction(); err != nil {
+			mockLogger.Errorf("LoadFixtures failed to discard the rows already inserted: %v", err)
+		}
+		if loadErr == nil {
+			return nil, fmt.Errorf("LoadFixtures failed because the transaction failed: %s", res.Message)
+		}
+		return nil, loadErr
+	}
+	return fixtures, nil
+}
+
+// Get returns a field of a loaded row, e.g. the ID generated for it
+func (fixtures *Fixtures) Get(table string, name string, field string) string {
+	value, ok := fixtures.rows[table][name][field]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// Row returns a loaded row by table and name
+func (fixtures *Fixtures) Row(table string, name string) map[string]interface{} {
+	return fixtures.rows[table][name]
+}
+
+// fixtureFiles expands the directories among paths into the fixture files they contain
+func fixtureFiles(paths []string) ([]string, error) {
+	files := make([]string, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("LoadFixtures failed because os.Stat failed with error %v", err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("LoadFixtures failed because ioutil.ReadDir failed with error %v", err)
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".yaml", ".yml", ".json":
+				names = append(names, entry.Name())
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+	return files, nil
+}
+
+// readFixture parses a fixture file
+func readFixture(file string) (*Fixture, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fixture := new(Fixture)
+	if filepath.Ext(file) == ".json" {
+		err = json.Unmarshal(content, fixture)
+	} else {
+		err = yaml.Unmarshal(content, fixture)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fixture.Table == "" {
+		fixture.Table = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	return fixture, nil
+}
+
+// load renders the rows of a fixture file and inserts them into the table
+func (fixtures *Fixtures) load(stub ChaincodeStubInterface, file string) error {
+	fixture, err := readFixture(file)
+	if err != nil {
+		return fmt.Errorf("LoadFixtures failed because fixture %s could not be read: %v", file, err)
+	}
+	if len(fixture.Keys) == 0 {
+		return fmt.Errorf("LoadFixtures failed because fixture %s has no keys", file)
+	}
+	if fixtures.rows[fixture.Table] == nil {
+		fixtures.rows[fixture.Table] = make(map[string]map[string]interface{})
+	}
+
+	for i, raw := range fixture.Rows {
+		row, err := fixtures.render(fixture.Table, i, normalizeYAML(raw).(map[string]interface{}))
+		if err != nil {
+			return fmt.Errorf("LoadFixtures failed because row %d of fixture %s could not be rendered: %v", i, file, err)
+		}
+
+		name, _ := row[fixtureNameField].(string)
+		delete(row, fixtureNameField)
+		rowKeys := make([]string, 0, len(fixture.Keys))
+		for _, field := range fixture.Keys {
+			value, ok := row[field]
+			if !ok {
+				return fmt.Errorf("LoadFixtures failed because row %d of fixture %s has no key field %s", i, file, field)
+			}
+			rowKeys = append(rowKeys, fmt.Sprint(value))
+		}
+
+		if _, err := InsertTableRow(stub, fixture.Table, rowKeys, row, FAIL_BEFORE_OVERWRITE, nil); err != nil {
+			return fmt.Errorf("LoadFixtures failed because row %d of fixture %s could not be inserted: %v", i, file, err)
+		}
+		if name != "" {
+			fixtures.rows[fixture.Table][name] = row
+		}
+	}
+	return nil
+}
+
+// render executes the templates of the string values of a row
+func (fixtures *Fixtures) render(table string, index int, row map[string]interface{}) (map[string]interface{}, error) {
+	name, _ := row[fixtureNameField].(string)
+	if name == "" {
+		name = fmt.Sprint(index)
+	}
+	ids := 0
+	funcs := template.FuncMap{
+		"id": func() string {
+			ids++
+			hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", table, name, ids)))
+			return hex.EncodeToString(hash[:8])
+		},
+		"uuid": genTxID,
+		"ref": func(table string, name string, field string) (string, error) {
+			row, ok := fixtures.rows[table][name]
+			if !ok {
+				return "", fmt.Errorf("row %s of table %s is not loaded", name, table)
+			}
+			value, ok := row[field]
+			if !ok {
+				return "", fmt.Errorf("row %s of table %s has no field %s", name, table, field)
+			}
+			return fmt.Sprint(value), nil
+		},
+	}
+	data := struct {
+		Table string
+		Index int
+	}{table, index}
+
+	var renderValue func(value interface{}) (interface{}, error)
+	renderValue = func(value interface{}) (interface{}, error) {
+		switch v := value.(type) {
+		case string:
+			tmpl, err := template.New(table).Funcs(funcs).Parse(v)
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, data); err != nil {
+				return nil, err
+			}
+			return buf.String(), nil
+		case map[string]interface{}:
+			rendered := make(map[string]interface{}, len(v))
+			// Render in a fixed order so that the generated IDs do not depend on the map iteration
+			for _, key := range sortedFields(v) {
+				r, err := renderValue(v[key])
+				if err != nil {
+					return nil, err
+				}
+				rendered[key] = r
+			}
+			return rendered, nil
+		case []interface{}:
+			rendered := make([]interface{}, len(v))
+			for i, item := range v {
+				r, err := renderValue(item)
+				if err != nil {
+					return nil, err
+				}
+				rendered[i] = r
+			}
+			return rendered, nil
+		}
+		return value, nil
+	}
+
+	rendered, err := renderValue(row)
+	if err != nil {
+		return nil, err
+	}
+	return rendered.(map[string]interface{}), nil
+}
+
+// normalizeYAML converts the map[interface{}]interface{} decoded by yaml into map[string]interface{} for json
+func normalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalizeYAML(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = normalizeYAML(item)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			l[i] = normalizeYAML(item)
+		}
+		return l
+	}
+	return value
+}
+
+func sortedFields(m map[string]interface{}) []string {
+	fields := make([]string, 0, len(m))
+	for field := range m {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
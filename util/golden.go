@@ -0,0 +1,160 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// exportedKey is a key of the ledger as it is exported, composite keys are decoded into their table and row keys
+type exportedKey struct {
+	Key                 string      `json:"key,omitempty"`
+	Table               string      `json:"table,omitempty"`
+	RowKeys             []string    `json:"rowKeys,omitempty"`
+	Value               interface{} `json:"value"`
+	ValidationParameter []byte      `json:"validationParameter,omitempty"`
+}
+
+// exportedState is the ledger of a stub as it is exported
+type exportedState struct {
+	State   []*exportedKey            `json:"state"`
+	Private map[string][]*exportedKey `json:"private,omitempty"`
+}
+
+// ExportState returns the ledger of the stub, public state and private data, as indented JSON.
+// Keys are sorted and JSON values are re-encoded with sorted fields so that the export is stable.
+func (stub *MockStubExtend) ExportState() ([]byte, error) {
+	keys, err := stub.allKeys()
+	if err != nil {
+		return nil, fmt.Errorf("ExportState failed because the keys could not be listed: %v", err)
+	}
+
+	export := &exportedState{State: make([]*exportedKey, 0, len(keys)), Private: make(map[string][]*exportedKey)}
+	for _, key := range keys {
+		state := stub.readKeyState(key)
+		exported := exportKey(key, state.value)
+		exported.ValidationParameter = state.validationParameter
+		export.State = append(export.State, exported)
+	}
+	for collection, values := range stub.PvtState {
+		if len(values) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(values))
+		for key := range values {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		for _, key := range names {
+			export.Private[collection] = append(export.Private[collection], exportKey(key, values[key]))
+		}
+	}
+
+	out, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("ExportState failed because json.MarshalIndent failed with error %v", err)
+	}
+	return append(out, '\n'), nil
+}
+
+// exportKey decodes a composite key and its JSON value
+func exportKey(key string, value []byte) *exportedKey {
+	exported := new(exportedKey)
+	if objectType, attributes, ok := splitCompositeKey(key); ok {
+		exported.Table = objectType
+		exported.RowKeys = attributes
+	} else {
+		exported.Key = key
+	}
+
+	// Numbers are kept as they are written, maps are re-encoded with sorted fields
+	var decoded interface{}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err == nil && !decoder.More() {
+		exported.Value = decoded
+	} else {
+		exported.Value = string(value)
+	}
+	return exported
+}
+
+// AssertGoldenState compares the exported ledger of the stub with the golden file at path.
+// If update is true, the golden file is written instead. A test package usually takes it from
+// an -update flag of its own, so that go test -update rewrites the golden files:
+//
+//	var update = flag.Bool("update", false, "rewrite the golden files")
+//	...
+//	util.AssertGoldenState(t, stub, "testdata/golden/state.json", *update)
+func AssertGoldenState(t testing.TB, stub *MockStubExtend, path string, update bool) {
+	t.Helper()
+	actual, err := stub.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("AssertGoldenState failed because os.MkdirAll failed with error %v", err)
+		}
+		if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+			t.Fatalf("AssertGoldenState failed because ioutil.WriteFile failed with error %v", err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("AssertGoldenState failed because golden file %s could not be read, run the test with update to create it: %v", path, err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("ledger state differs from golden file %s, run the test with update to accept the changes:\n%s",
+			path, diffLines(string(expected), string(actual)))
+	}
+}
+
+// diffLines returns the lines removed from (-) and added to (+) expected to get actual
+func diffLines(expected, actual string) string {
+	a := strings.Split(expected, "\n")
+	b := strings.Split(actual, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&out, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+ %s\n", b[j])
+			j++
+		}
+	}
+	return out.String()
+}
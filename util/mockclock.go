@@ -0,0 +1,58 @@
+package util
+
+import (
+	"time"
+)
+
+// MockClock drives the transaction timestamp of MockStubExtend so that tests can
+// control what the chaincode gets from GetTxTimestamp.
+// Each mock transaction takes the next scripted timestamp if there is one,
+// otherwise the current time of the clock. The clock then moves forward by its step.
+type MockClock struct {
+	current  time.Time
+	step     time.Duration
+	scripted []time.Time
+}
+
+// NewMockClock returns a clock that is fixed at start until it is moved by the test
+func NewMockClock(start time.Time) *MockClock {
+	return &MockClock{current: start}
+}
+
+// Now returns the timestamp the clock is currently set to
+func (clock *MockClock) Now() time.Time {
+	return clock.current
+}
+
+// Set moves the clock to t
+func (clock *MockClock) Set(t time.Time) {
+	clock.current = t
+}
+
+// Advance moves the clock forward by d
+func (clock *MockClock) Advance(d time.Duration) {
+	clock.current = clock.current.Add(d)
+}
+
+// SetStep makes the clock move forward by d after every transaction.
+// A step of 0 (the default) keeps the clock fixed.
+func (clock *MockClock) SetStep(d time.Duration) {
+	clock.step = d
+}
+
+// Script queues timestamps to be used, in order, by the next transactions.
+// Once the queue is empty the clock carries on from the last scripted timestamp.
+func (clock *MockClock) Script(times ...time.Time) {
+	clock.scripted = append(clock.scripted, times...)
+}
+
+// next returns the timestamp of the next transaction and moves the clock along
+func (clock *MockClock) next() time.Time {
+	if len(clock.scripted) > 0 {
+		clock.current = clock.scripted[0]
+		clock.scripted = clock.scripted[1:]
+	}
+	txTime := clock.current
+	clock.current = clock.current.Add(clock.step)
+	return txTime
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+// Operations of the stub that faults can be injected into
+const (
+	OpGetState                                    = "GetState"
+	OpPutState                                    = "PutState"
+	OpDelState                                    = "DelState"
+	OpGetStateByRange                             = "GetStateByRange"
+	OpGetStateByPartialCompositeKey               = "GetStateByPartialCompositeKey"
+	OpGetStateByPartialCompositeKeyWithPagination = "GetStateByPartialCompositeKeyWithPagination"
+	OpGetQueryResult                              = "GetQueryResult"
+	OpGetQueryResultWithPagination                = "GetQueryResultWithPagination"
+	OpSetStateValidationParameter                 = "SetStateValidationParameter"
+	OpGetStateValidationParameter                 = "GetStateValidationParameter"
+	OpGetPrivateData                              = "GetPrivateData"
+	OpPutPrivateData                              = "PutPrivateData"
+	OpDelPrivateData                              = "DelPrivateData"
+)
+
+// ErrMockTimeout is a convenient error to simulate a state database that does not answer in time
+var ErrMockTimeout = errors.New("mock state database timed out")
+
+// MockFault describes a failure injected into the stub, e.g. the 3rd GetState of a key matching Data_*.
+// The key of a call is matched against Pattern with path.Match, composite keys in their readable
+// form objectType(attr1,attr2); range queries match on their start key and rich queries on the query string.
+type MockFault struct {
+	Operation string        // stub function that fails, e.g. OpGetState
+	Pattern   string        // pattern of the keys that fail, empty matches every key
+	Nth       int           // only the nth matching call fails, 0 makes every matching call fail
+	Err       error         // error returned by the call, nil only adds the latency
+	Latency   time.Duration // delay added to the call before it returns
+	calls     int           // number of matching calls so far
+}
+
+// InjectFault makes the stub fail the calls described by fault until ClearFaults is called
+func (stub *MockStubExtend) InjectFault(fault *MockFault) error {
+	if _, err := path.Match(fault.Pattern, ""); err != nil {
+		return fmt.Errorf("InjectFault failed because pattern %s is invalid: %v", fault.Pattern, err)
+	}
+	stub.faults = append(stub.faults, fault)
+	return nil
+}
+
+// ClearFaults removes every injected fault
+func (stub *MockStubExtend) ClearFaults() {
+	stub.faults = nil
+}
+
+// fault applies the faults injected into operation for key and returns the error of the first that fires
+func (stub *MockStubExtend) fault(operation string, key string) error {
+	for _, f := range stub.faults {
+		if f.Operation != operation || !f.matches(key) {
+			continue
+		}
+		f.calls++
+		if f.Nth > 0 && f.calls != f.Nth {
+			continue
+		}
+		if f.Latency > 0 {
+			time.Sleep(f.Latency)
+		}
+		if f.Err != nil {
+			mockLogger.Infof("Injected fault in %s(%s): %v", operation, readableKey(key), f.Err)
+			return f.Err
+		}
+	}
+	return nil
+}
+
+func (f *MockFault) matches(key string) bool {
+	if f.Pattern == "" {
+		return true
+	}
+	if ok, _ := path.Match(f.Pattern, readableKey(key)); ok {
+		return true
+	}
+	ok, _ := path.Match(f.Pattern, key)
+	return ok
+}
@@ -0,0 +1,74 @@
+package util
+
+import (
+	"fmt"
+
+	. "github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+)
+
+// OpGetHistoryForKey is the operation of GetHistoryForKey that faults can be injected into
+const OpGetHistoryForKey = "GetHistoryForKey"
+
+// GetHistoryForKey overrides the same function in MockStub that did not implement anything.
+// Like the history database of a peer, it returns every committed write of key from the oldest to the newest.
+func (stub *MockStubExtend) GetHistoryForKey(key string) (HistoryQueryIteratorInterface, error) {
+	if err := stub.fault(OpGetHistoryForKey, key); err != nil {
+		return nil, err
+	}
+	modifications := make([]*queryresult.KeyModification, len(stub.history[key]))
+	copy(modifications, stub.history[key])
+	return &mockHistoryIterator{modifications: modifications}, nil
+}
+
+// recordHistory adds the value writes of a transaction that is being committed to the history of their keys
+func (stub *MockStubExtend) recordHistory(tx *txSimulation) {
+	for _, key := range sortedKeys(tx.valueWrites) {
+		value, _ := stub.getState(key)
+		stub.history[key] = append(stub.history[key], &queryresult.KeyModification{
+			TxId:      tx.txID,
+			Value:     value,
+			Timestamp: stub.TxTimestamp,
+			IsDelete:  value == nil,
+		})
+	}
+}
+
+// rollbackHistory removes the history entries added by the last transaction
+func (stub *MockStubExtend) rollbackHistory(tx *txSimulation) {
+	for key := range tx.valueWrites {
+		entries := stub.history[key]
+		if n := len(entries); n > 0 && entries[n-1].TxId == tx.txID {
+			stub.history[key] = entries[:n-1]
+		}
+		if len(stub.history[key]) == 0 {
+			delete(stub.history, key)
+		}
+	}
+}
+
+// mockHistoryIterator iterates over the history of a key
+type mockHistoryIterator struct {
+	modifications []*queryresult.KeyModification
+	current       int
+}
+
+// HasNext returns true if the iterator has more history entries
+func (iter *mockHistoryIterator) HasNext() bool {
+	return iter.current < len(iter.modifications)
+}
+
+// Next returns the next history entry
+func (iter *mockHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	if !iter.HasNext() {
+		return nil, fmt.Errorf("no more history entries")
+	}
+	modification := iter.modifications[iter.current]
+	iter.current++
+	return modification, nil
+}
+
+// Close closes the iterator
+func (iter *mockHistoryIterator) Close() error {
+	return nil
+}
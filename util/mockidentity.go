@@ -0,0 +1,119 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/bccsp/utils"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// MockIdentity simulates the identity of a client submitting transactions:
+// an MSP ID along with an ECDSA key and its self-signed certificate.
+type MockIdentity struct {
+	MspID       string
+	Certificate *x509.Certificate
+	CertPEM     []byte
+	key         *ecdsa.PrivateKey
+}
+
+// NewMockIdentity generates a new key and certificate for a member of mspID
+func NewMockIdentity(mspID string, commonName string) (*MockIdentity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("NewMockIdentity failed because ecdsa.GenerateKey failed with error %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("NewMockIdentity failed because the serial number could not be generated: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{mspID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * 365 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("NewMockIdentity failed because x509.CreateCertificate failed with error %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("NewMockIdentity failed because x509.ParseCertificate failed with error %v", err)
+	}
+
+	return &MockIdentity{
+		MspID:       mspID,
+		Certificate: cert,
+		CertPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:         key,
+	}, nil
+}
+
+// Serialize returns the identity the way the chaincode gets it from GetCreator
+func (identity *MockIdentity) Serialize() ([]byte, error) {
+	return proto.Marshal(&msp.SerializedIdentity{Mspid: identity.MspID, IdBytes: identity.CertPEM})
+}
+
+// deserializeMockIdentity parses a serialized identity, the returned identity has no private key and cannot sign
+func deserializeMockIdentity(serialized []byte) (*MockIdentity, error) {
+	sid := new(msp.SerializedIdentity)
+	if err := proto.Unmarshal(serialized, sid); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(sid.IdBytes)
+	if block == nil {
+		return nil, fmt.Errorf("identity of %s has no PEM certificate", sid.Mspid)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &MockIdentity{MspID: sid.Mspid, Certificate: cert, CertPEM: sid.IdBytes}, nil
+}
+
+// Sign signs the SHA-256 digest of msg with a low-S ECDSA signature, as Fabric expects
+func (identity *MockIdentity) Sign(msg []byte) ([]byte, error) {
+	if identity.key == nil {
+		return nil, fmt.Errorf("identity of %s has no private key", identity.MspID)
+	}
+	digest := sha256.Sum256(msg)
+	r, s, err := ecdsa.Sign(rand.Reader, identity.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	s, _, err = utils.ToLowS(&identity.key.PublicKey, s)
+	if err != nil {
+		return nil, err
+	}
+	return utils.MarshalECDSASignature(r, s)
+}
+
+// Verify checks a signature made by Sign against the certificate of the identity,
+// so that it also works for identities without private key
+func (identity *MockIdentity) Verify(msg []byte, signature []byte) bool {
+	if identity.Certificate == nil {
+		return false
+	}
+	publicKey, ok := identity.Certificate.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return false
+	}
+	r, s, err := utils.UnmarshalECDSASignature(signature)
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256(msg)
+	return ecdsa.Verify(publicKey, digest[:], r, s)
+}
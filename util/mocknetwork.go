@@ -0,0 +1,211 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/common/cauthdsl"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// MockNetwork simulates a channel where each org runs its own peer with its own instance of the chaincode.
+// A transaction is executed on the peers of the endorsing orgs, their results are compared
+// and the endorsement policy is evaluated before the writes are committed to every peer.
+// The peers keep their state in memory, as they would otherwise share the same couchDB database.
+type MockNetwork struct {
+	Peers  map[string]*MockStubExtend // one peer per org MSP ID
+	policy *common.SignaturePolicyEnvelope
+}
+
+// endorsement is what a single peer returns after simulating a transaction
+type endorsement struct {
+	org      string
+	response pb.Response
+	reads    *kvrwset.KVRWSet // keys and ranges read by the transaction, with their versions
+	writes   txWriteSet       // state of the written keys after the transaction
+	previous txWriteSet       // state of the written keys before the transaction
+}
+
+// NewMockNetwork creates a peer for every org, each running the chaincode returned by newChaincode.
+// Like on a real network, the peers do not share the memory of the chaincode.
+// policy is the chaincode-level endorsement policy, e.g. AND('Org1MSP.member','Org2MSP.member')
+func NewMockNetwork(policy string, newChaincode func() shim.Chaincode, orgs ...string) (*MockNetwork, error) {
+	envelope, err := cauthdsl.FromString(policy)
+	if err != nil {
+		return nil, fmt.Errorf("NewMockNetwork failed because the endorsement policy is invalid: %v", err)
+	}
+
+	network := &MockNetwork{Peers: make(map[string]*MockStubExtend), policy: envelope}
+	for _, org := range orgs {
+		cc := newChaincode()
+		network.Peers[org] = NewMockStubExtend(shim.NewMockStub(org, cc), cc)
+	}
+	return network, nil
+}
+
+// MockInit instantiates the chaincode with the peers of the endorsing orgs and commits the result on every peer
+func (network *MockNetwork) MockInit(uuid string, args [][]byte, endorsers ...string) (pb.Response, error) {
+	return network.mockTransaction(endorsers, func(peer *MockStubExtend) pb.Response {
+		return peer.MockInit(uuid, args)
+	})
+}
+
+// MockInvoke invokes the chaincode with the peers of the endorsing orgs and commits the result on every peer.
+// An error is returned, and nothing is committed, if the endorsements do not match
+// or if they do not satisfy the chaincode-level and key-level endorsement policies.
+func (network *MockNetwork) MockInvoke(uuid string, args [][]byte, endorsers ...string) (pb.Response, error) {
+	return network.mockTransaction(endorsers, func(peer *MockStubExtend) pb.Response {
+		return peer.MockInvoke(uuid, args)
+	})
+}
+
+func (network *MockNetwork) mockTransaction(endorsers []string, execute func(*MockStubExtend) pb.Response) (pb.Response, error) {
+	if len(endorsers) == 0 {
+		return pb.Response{}, fmt.Errorf("no endorsing org was given")
+	}
+
+	// Simulate the transaction on each endorsing peer without committing anything
+	endorsements := make([]*endorsement, 0, len(endorsers))
+	for _, org := range endorsers {
+		peer, ok := network.Peers[org]
+		if !ok {
+			return pb.Response{}, fmt.Errorf("org %s has no peer in the network", org)
+		}
+		e, err := simulate(peer, org, execute)
+		if err != nil {
+			return pb.Response{}, err
+		}
+		endorsements = append(endorsements, e)
+	}
+
+	first := endorsements[0]
+	for _, e := range endorsements[1:] {
+		if err := compareEndorsements(first, e); err != nil {
+			return first.response, err
+		}
+	}
+	if first.response.Status >= shim.ERRORTHRESHOLD {
+		return first.response, fmt.Errorf("endorsement failed with status %d: %s", first.response.Status, first.response.Message)
+	}
+	if err := network.validate(first, endorsers); err != nil {
+		return first.response, err
+	}
+
+	// Commit the writes on every peer of the network
+	for org, peer := range network.Peers {
+		for key, state := range first.writes {
+			if err := peer.writeKeyState(key, state); err != nil {
+				return first.response, fmt.Errorf("failed to commit key %s on the peer of %s: %v", key, org, err)
+			}
+		}
+	}
+	return first.response, nil
+}
+
+// simulate executes the transaction on peer, captures its reads and writes then rolls the writes back
+func simulate(peer *MockStubExtend, org string, execute func(*MockStubExtend) pb.Response) (*endorsement, error) {
+	res := execute(peer)
+	if peer.lastTx == nil {
+		return nil, fmt.Errorf("the transaction was not simulated on the peer of %s: %s", org, res.Message)
+	}
+	e := &endorsement{
+		org:      org,
+		response: res,
+		reads:    peer.lastRWSet.PubRWSet,
+		writes:   peer.lastTxWrittenState(),
+		previous: peer.lastTx.writes,
+	}
+
+	if err := peer.rollbackLastTransaction(); err != nil {
+		return nil, fmt.Errorf("failed to roll back the simulation on the peer of %s: %v", org, err)
+	}
+	return e, nil
+}
+
+// compareEndorsements returns an error describing how two endorsements of the same proposal differ
+func compareEndorsements(a, b *endorsement) error {
+	if a.response.Status != b.response.Status || a.response.Message != b.response.Message ||
+		!bytes.Equal(a.response.Payload, b.response.Payload) {
+		return fmt.Errorf("endorsement mismatch: %s responded %d %q, %s responded %d %q",
+			a.org, a.response.Status, a.response.Payload, b.org, b.response.Status, b.response.Payload)
+	}
+	if keys := diffReadSets(a.reads, b.reads); len(keys) > 0 {
+		return fmt.Errorf("endorsement mismatch: read sets of %s and %s differ on %q", a.org, b.org, keys)
+	}
+	if keys := diffWriteSets(a.writes, b.writes); len(keys) > 0 {
+		return fmt.Errorf("endorsement mismatch: write sets of %s and %s differ on keys %q", a.org, b.org, keys)
+	}
+	return nil
+}
+
+// diffWriteSets returns the sorted keys that are not written the same way in a and b
+func diffWriteSets(a, b txWriteSet) []string {
+	keys := make([]string, 0)
+	for key, sa := range a {
+		sb, ok := b[key]
+		if !ok || !bytes.Equal(sa.value, sb.value) || !bytes.Equal(sa.validationParameter, sb.validationParameter) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffReadSets returns the sorted keys and range queries that are not read the same way in a and b
+func diffReadSets(a, b *kvrwset.KVRWSet) []string {
+	ra, rb := readVersions(a), readVersions(b)
+	keys := make([]string, 0)
+	for key, va := range ra {
+		if vb, ok := rb[key]; !ok || va != vb {
+			keys = append(keys, key)
+		}
+	}
+	for key := range rb {
+		if _, ok := ra[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readVersions returns the version read of every key of a read set, range queries are listed
+// with the keys they returned
+func readVersions(reads *kvrwset.KVRWSet) map[string]string {
+	versions := make(map[string]string)
+	for _, r := range reads.Reads {
+		versions[readableKey(r.Key)] = readableVersion(r.Version)
+	}
+	for _, q := range reads.RangeQueriesInfo {
+		returned := make([]string, 0, len(q.GetRawReads().GetKvReads()))
+		for _, r := range q.GetRawReads().GetKvReads() {
+			returned = append(returned, readableKey(r.Key)+" "+readableVersion(r.Version))
+		}
+		versions["range "+readableKey(q.StartKey)+" to "+readableKey(q.EndKey)] = fmt.Sprintf("%q exhausted %t", returned, q.ItrExhausted)
+	}
+	return versions
+}
+
+// validate checks the endorsements against the key-level policies of the written keys
+// and against the chaincode-level policy for the keys that have none
+func (network *MockNetwork) validate(e *endorsement, endorsers []string) error {
+	checkChaincodePolicy := len(e.writes) == 0
+	for _, old := range e.previous {
+		if len(old.validationParameter) == 0 {
+			checkChaincodePolicy = true
+		}
+	}
+	if checkChaincodePolicy && !policySatisfied(network.policy, endorsers) {
+		return fmt.Errorf("chaincode-level endorsement policy is not satisfied by orgs %v", endorsers)
+	}
+	return validateKeyLevelEndorsement(e.previous, endorsers)
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// MockQuery runs the chaincode the way a gateway evaluates a transaction: it is simulated but never committed.
+// Whatever the chaincode writes (state, metadata or private data) is discarded once it returns.
+// The discarded writes are reported in the log and remain visible through LastTxRWSet.
+func (stub *MockStubExtend) MockQuery(uuid string, args [][]byte) pb.Response {
+	txTimestamp := stub.nextTxTimestamp()
+	res := stub.mockTransaction(uuid, args, nil, txTimestamp, stub.cc.Invoke)
+	stub.record(RecordedQuery, uuid, args, nil, txTimestamp, res)
+
+	rwset := stub.LastTxRWSet()
+	if rwset == nil || !rwset.HasWrites() {
+		return res
+	}
+	mockLogger.Warningf("MockQuery discarded the writes of transaction %s:\n%s", uuid, rwset.Diff())
+	if err := stub.rollbackLastTransaction(); err != nil {
+		mockLogger.Errorf("MockQuery failed to discard the writes of transaction %s: %v", uuid, err)
+	}
+	return res
+}
+
+// HasWrites tells whether the transaction wrote anything, be it state, metadata or private data
+func (rwset *TxRWSet) HasWrites() bool {
+	if len(rwset.PubRWSet.Writes) > 0 || len(rwset.PubRWSet.MetadataWrites) > 0 {
+		return true
+	}
+	for _, hashed := range rwset.CollHashedRWSets {
+		if len(hashed.HashedWrites) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
+)
+
+// stateSnapshot is the ledger of a stub at the time Snapshot was called
+type stateSnapshot struct {
+	state       txWriteSet // every public key with its key-level endorsement policy and version
+	pvtState    map[string]map[string][]byte
+	pvtVersions map[string]map[string]*kvrwset.Version
+	history     map[string][]*queryresult.KeyModification
+	height      uint64
+}
+
+// Snapshot saves the ledger of the stub, in memory or in couchDB, along with its private data,
+// key versions and history. The returned id can be given to Restore as many times as needed,
+// so an expensive base state can be built once and shared by many test scenarios.
+func (stub *MockStubExtend) Snapshot() (string, error) {
+	snapshot, err := stub.takeSnapshot()
+	if err != nil {
+		return "", fmt.Errorf("Snapshot failed because %v", err)
+	}
+	id := fmt.Sprintf("snapshot-%d", len(stub.snapshots)+1)
+	stub.snapshots[id] = snapshot
+	return id, nil
+}
+
+// Restore brings the ledger of the stub back to the state saved by Snapshot.
+// Only the keys that changed since the snapshot are written back to the database.
+func (stub *MockStubExtend) Restore(id string) error {
+	snapshot, ok := stub.snapshots[id]
+	if !ok {
+		return fmt.Errorf("Restore failed because snapshot %s does not exist", id)
+	}
+	if err := stub.restoreSnapshot(snapshot); err != nil {
+		return fmt.Errorf("Restore failed because %v", err)
+	}
+	return nil
+}
+
+// takeSnapshot copies the ledger of the stub
+func (stub *MockStubExtend) takeSnapshot() (*stateSnapshot, error) {
+	if stub.tx != nil {
+		return nil, fmt.Errorf("transaction %s is running", stub.tx.txID)
+	}
+	keys, err := stub.allKeys()
+	if err != nil {
+		return nil, fmt.Errorf("the keys could not be listed: %v", err)
+	}
+
+	snapshot := &stateSnapshot{
+		state:       make(txWriteSet),
+		pvtState:    make(map[string]map[string][]byte),
+		pvtVersions: make(map[string]map[string]*kvrwset.Version),
+		history:     make(map[string][]*queryresult.KeyModification),
+		height:      stub.height,
+	}
+	for _, key := range keys {
+		snapshot.state[key] = stub.readKeyState(key)
+	}
+	for collection, values := range stub.PvtState {
+		snapshot.pvtState[collection] = make(map[string][]byte)
+		for key, value := range values {
+			snapshot.pvtState[collection][key] = value
+		}
+	}
+	for collection, versions := range stub.pvtVersions {
+		snapshot.pvtVersions[collection] = make(map[string]*kvrwset.Version)
+		for key, version := range versions {
+			snapshot.pvtVersions[collection][key] = version
+		}
+	}
+	for key, modifications := range stub.history {
+		snapshot.history[key] = append([]*queryresult.KeyModification(nil), modifications...)
+	}
+	return snapshot, nil
+}
+
+// restoreSnapshot brings the ledger of the stub back to a copy taken by takeSnapshot
+func (stub *MockStubExtend) restoreSnapshot(snapshot *stateSnapshot) error {
+	if stub.tx != nil {
+		return fmt.Errorf("transaction %s is running", stub.tx.txID)
+	}
+	keys, err := stub.allKeys()
+	if err != nil {
+		return fmt.Errorf("the keys could not be listed: %v", err)
+	}
+
+	for _, key := range keys {
+		if _, ok := snapshot.state[key]; !ok {
+			if err := stub.writeKeyState(key, &keyState{}); err != nil {
+				return fmt.Errorf("key %s could not be deleted: %v", key, err)
+			}
+		}
+	}
+	for _, key := range sortedKeys(snapshot.state) {
+		state := snapshot.state[key]
+		if sameKeyState(stub.readKeyState(key), state) {
+			continue
+		}
+		if err := stub.writeKeyState(key, state); err != nil {
+			return fmt.Errorf("key %s could not be written: %v", key, err)
+		}
+	}
+
+	stub.PvtState = make(map[string]map[string][]byte)
+	for collection, values := range snapshot.pvtState {
+		stub.PvtState[collection] = make(map[string][]byte)
+		for key, value := range values {
+			stub.PvtState[collection][key] = value
+		}
+	}
+	stub.pvtVersions = make(map[string]map[string]*kvrwset.Version)
+	for collection, versions := range snapshot.pvtVersions {
+		stub.pvtVersions[collection] = make(map[string]*kvrwset.Version)
+		for key, version := range versions {
+			stub.pvtVersions[collection][key] = version
+		}
+	}
+	stub.history = make(map[string][]*queryresult.KeyModification)
+	for key, modifications := range snapshot.history {
+		stub.history[key] = append([]*queryresult.KeyModification(nil), modifications...)
+	}
+	stub.height = snapshot.height
+	stub.lastTx = nil
+	stub.lastRWSet = nil
+	return nil
+}
+
+// allKeys returns every public key of the ledger
+func (stub *MockStubExtend) allKeys() ([]string, error) {
+	keys := make([]string, 0)
+	if !stub.CouchDB {
+		for elem := stub.Keys.Front(); elem != nil; elem = elem.Next() {
+			keys = append(keys, elem.Value.(string))
+		}
+		return keys, nil
+	}
+
+	iterator, err := stub.getStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range iterator.data {
+		keys = append(keys, item.ID)
+	}
+	return keys, nil
+}
+
+func sameKeyState(a, b *keyState) bool {
+	return bytes.Equal(a.value, b.value) && bytes.Equal(a.validationParameter, b.validationParameter) &&
+		proto.Equal(a.version, b.version)
+}
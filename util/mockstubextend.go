@@ -3,19 +3,31 @@ package util
 import (
 	"errors"
 	"fmt"
-	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
 	"strings"
+	"testing"
 	"unicode/utf8"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	. "github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/handlers/decoration"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
 	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric/protos/utils"
 
 	logging "github.com/op/go-logging"
 	viper "github.com/spf13/viper"
 )
 
 const (
-	maxUnicodeRuneValue = utf8.MaxRune //U+10FFFF - maximum (and unallocated) code point
+	minUnicodeRuneValue   = '\u0000'     //U+0000
+	maxUnicodeRuneValue   = utf8.MaxRune //U+10FFFF - maximum (and unallocated) code point
+	compositeKeyNamespace = "\x00"
 )
 
 // Logger for the shim package.
@@ -23,28 +35,58 @@ var mockLogger = logging.MustGetLogger("mockStubExtend")
 
 // MockStubExtend provides composition class for MockStub as some of the mockstub methods are not implemented
 type MockStubExtend struct {
-	args      [][]byte        // this is private in MockStub
-	cc        Chaincode       // this is private in MockStub
-	CouchDB   bool            // if we use couchDB
-	DbHandler *CouchDBHandler // if we use couchDB
+	args            [][]byte                                  // this is private in MockStub
+	cc              Chaincode                                 // this is private in MockStub
+	transient       map[string][]byte                         // transient map of the running transaction
+	tx              *txSimulation                             // what the running transaction reads and writes
+	lastTx          *txSimulation                             // what the last transaction read and wrote
+	lastRWSet       *TxRWSet                                  // read/write set of the last transaction
+	versions        map[string]*kvrwset.Version               // committed version of each key
+	pvtVersions     map[string]map[string]*kvrwset.Version    // committed version of each private key, by collection
+	height          uint64                                    // number of committed mock transactions
+	signedProposal  *pb.SignedProposal                        // this is private in MockStub
+	binding         []byte                                    // binding of the running transaction proposal
+	decorations     map[string][]byte                         // decorations of the running transaction input
+	Decorators      []decoration.Decorator                    // if set, decorate the chaincode input of every transaction like the peer does
+	CouchDB         bool                                      // if we use couchDB
+	DbHandler       *CouchDBHandler                           // if we use couchDB
+	Clock           *MockClock                                // if set, drives the transaction timestamp instead of the wall clock
+	Creator         *MockIdentity                             // if set, the identity that signs the transaction proposals
+	nonDeterminismT testing.TB                                // if set, every invoke runs twice and divergences are reported here
+	faults          []*MockFault                              // failures injected into the stub operations
+	history         map[string][]*queryresult.KeyModification // committed writes of each key, oldest first
+	snapshots       map[string]*stateSnapshot                 // ledger states saved by Snapshot
+	recording       *TxRecording                              // if set, every transaction is recorded here
+	tableTx         *tableTxState                             // what the table functions wrote in the running transaction
 	*MockStub
 }
 
 // GetQueryResult overrides the same function in MockStub
 // that did not implement anything.
 func (stub *MockStubExtend) GetQueryResult(query string) (StateQueryIteratorInterface, error) {
+	if err := stub.fault(OpGetQueryResult, query); err != nil {
+		return nil, err
+	}
 	// Query data from couchDB
 	raw, error := stub.DbHandler.QueryDocument(query)
 	if error != nil {
 		return nil, error
 	}
-	return FromResultsIterator(raw)
+	iterator, error := FromResultsIterator(raw)
+	if error != nil {
+		return nil, error
+	}
+	stub.countRichQuery(iterator)
+	return iterator, nil
 }
 
 // GetQueryResultWithPagination overrides the same function in MockStub
 // that did not implement anything.
 func (stub *MockStubExtend) GetQueryResultWithPagination(query string, pageSize int32,
 	bookmark string) (StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	if err := stub.fault(OpGetQueryResultWithPagination, query); err != nil {
+		return nil, nil, err
+	}
 
 	raw, er := stub.DbHandler.QueryDocumentWithPagination(query, pageSize, bookmark)
 	if er != nil {
@@ -56,6 +98,7 @@ func (stub *MockStubExtend) GetQueryResultWithPagination(query string, pageSize
 		return nil, nil, er
 	}
 
+	stub.countRichQuery(iterator)
 	bm := raw.(statedb.QueryResultsIterator).GetBookmarkAndClose()
 	queryResponse := &pb.QueryResponseMetadata{FetchedRecordsCount: int32(iterator.Length()), Bookmark: bm}
 
@@ -68,6 +111,13 @@ func NewMockStubExtend(stub *MockStub, c Chaincode) *MockStubExtend {
 	s.MockStub = stub
 	s.cc = c
 	s.CouchDB = false
+	if s.ChannelID == "" {
+		s.ChannelID = DefaultChannelName
+	}
+	s.versions = make(map[string]*kvrwset.Version)
+	s.pvtVersions = make(map[string]map[string]*kvrwset.Version)
+	s.history = make(map[string][]*queryresult.KeyModification)
+	s.snapshots = make(map[string]*stateSnapshot)
 	viper.SetConfigName("core")
 	viper.AddConfigPath(".")
 	err := viper.ReadInConfig() // Find and read the config file
@@ -85,22 +135,200 @@ func (stub *MockStubExtend) SetCouchDBConfiguration(handler *CouchDBHandler) {
 
 // MockInvoke Override this function from MockStub
 func (stub *MockStubExtend) MockInvoke(uuid string, args [][]byte) pb.Response {
-	stub.args = args
-	stub.MockTransactionStart(uuid)
-	res := stub.cc.Invoke(stub)
-	stub.MockTransactionEnd(uuid)
-	return res
+	return stub.MockInvokeWithTransient(uuid, args, nil)
 }
 
 // MockInit Override this function from MockStub
 func (stub *MockStubExtend) MockInit(uuid string, args [][]byte) pb.Response {
+	return stub.MockInitWithTransient(uuid, args, nil)
+}
+
+// MockInvokeWithTransient invokes the chaincode with a transient map that is
+// returned by GetTransient for the duration of the transaction only.
+func (stub *MockStubExtend) MockInvokeWithTransient(uuid string, args [][]byte, transient map[string][]byte) pb.Response {
+	txTimestamp := stub.nextTxTimestamp()
+	var res pb.Response
+	if stub.nonDeterminismT != nil {
+		res = stub.mockInvokeTwice(uuid, args, transient, txTimestamp)
+	} else {
+		res = stub.mockTransaction(uuid, args, transient, txTimestamp, stub.cc.Invoke)
+	}
+	stub.record(RecordedInvoke, uuid, args, transient, txTimestamp, res)
+	return res
+}
+
+// MockInitWithTransient initialises the chaincode with a transient map that is
+// returned by GetTransient for the duration of the transaction only.
+func (stub *MockStubExtend) MockInitWithTransient(uuid string, args [][]byte, transient map[string][]byte) pb.Response {
+	txTimestamp := stub.nextTxTimestamp()
+	res := stub.mockTransaction(uuid, args, transient, txTimestamp, stub.cc.Init)
+	stub.record(RecordedInit, uuid, args, transient, txTimestamp, res)
+	return res
+}
+
+// MockTransactionStart overrides the same function in MockStub to also forget
+// what the table functions wrote in the previous transaction
+func (stub *MockStubExtend) MockTransactionStart(txid string) {
+	stub.MockStub.MockTransactionStart(txid)
+	stub.tableTx = newTableTxState()
+}
+
+// tableTxState returns what the table functions wrote in the running transaction
+func (stub *MockStubExtend) tableTxState() *tableTxState {
+	if stub.tableTx == nil {
+		stub.tableTx = newTableTxState()
+	}
+	return stub.tableTx
+}
+
+// mockTransaction wraps a single Init or Invoke call between MockTransactionStart and MockTransactionEnd
+func (stub *MockStubExtend) mockTransaction(uuid string, args [][]byte, transient map[string][]byte,
+	txTimestamp *timestamp.Timestamp, execute func(ChaincodeStubInterface) pb.Response) pb.Response {
 	stub.args = args
+	stub.transient = transient
+	// Until the transaction is committed, nothing must be taken for its read/write set
+	stub.lastTx, stub.lastRWSet = nil, nil
+	stub.tx = newTxSimulation(uuid)
 	stub.MockTransactionStart(uuid)
-	res := stub.cc.Init(stub)
+	stub.TxTimestamp = txTimestamp
+
+	sp, err := stub.newRecordedProposal(uuid)
+	if err != nil {
+		stub.MockTransactionEnd(uuid)
+		stub.tx = nil
+		return Error(fmt.Sprintf("cannot create proposal for transaction %s: %s", uuid, err))
+	}
+	stub.signedProposal = sp
+
+	res := execute(stub)
+
 	stub.MockTransactionEnd(uuid)
+	stub.signedProposal = nil
+	stub.binding = nil
+	stub.decorations = nil
+	stub.transient = nil
+	stub.commit()
 	return res
 }
 
+// nextTxTimestamp returns the timestamp of the next transaction, taken from Clock if there is one
+func (stub *MockStubExtend) nextTxTimestamp() *timestamp.Timestamp {
+	if stub.Clock != nil {
+		txTimestamp, _ := ptypes.TimestampProto(stub.Clock.next())
+		return txTimestamp
+	}
+	return ptypes.TimestampNow()
+}
+
+// newRecordedProposal builds the signed proposal of the running transaction as it would be recorded in a block.
+// The peer strips the transient map off the proposal payload before it goes into the transaction,
+// so the transient data never shows up in the recorded proposal. The proposal is signed by Creator,
+// over the bytes the chaincode gets, so that the chaincode can verify the signature.
+func (stub *MockStubExtend) newRecordedProposal(txID string) (*pb.SignedProposal, error) {
+	var creator []byte
+	var err error
+	if stub.Creator != nil {
+		if creator, err = stub.Creator.Serialize(); err != nil {
+			return nil, err
+		}
+	}
+	nonce, err := utils.CreateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	ccHdrExt, err := proto.Marshal(&pb.ChaincodeHeaderExtension{ChaincodeId: &pb.ChaincodeID{Name: stub.Name}})
+	if err != nil {
+		return nil, err
+	}
+	channelHeader, err := proto.Marshal(&common.ChannelHeader{
+		Type:      int32(common.HeaderType_ENDORSER_TRANSACTION),
+		TxId:      txID,
+		Timestamp: stub.TxTimestamp,
+		ChannelId: stub.ChannelID,
+		Extension: ccHdrExt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	signatureHeader, err := proto.Marshal(&common.SignatureHeader{Nonce: nonce, Creator: creator})
+	if err != nil {
+		return nil, err
+	}
+	header, err := proto.Marshal(&common.Header{ChannelHeader: channelHeader, SignatureHeader: signatureHeader})
+	if err != nil {
+		return nil, err
+	}
+
+	cis, err := proto.Marshal(&pb.ChaincodeInvocationSpec{
+		ChaincodeSpec: &pb.ChaincodeSpec{
+			Type:        pb.ChaincodeSpec_GOLANG,
+			ChaincodeId: &pb.ChaincodeID{Name: stub.Name},
+			Input:       &pb.ChaincodeInput{Args: stub.args},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := utils.GetBytesProposalPayloadForTx(&pb.ChaincodeProposalPayload{Input: cis, TransientMap: stub.transient}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	prop := &pb.Proposal{Header: header, Payload: payload}
+	if stub.binding, err = utils.ComputeProposalBinding(prop); err != nil {
+		return nil, err
+	}
+	input := &pb.ChaincodeInput{Args: stub.args, Decorations: make(map[string][]byte)}
+	stub.decorations = decoration.Apply(prop, input, stub.Decorators...).Decorations
+	propBytes, err := utils.GetBytesProposal(prop)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := &pb.SignedProposal{ProposalBytes: propBytes}
+	if stub.Creator != nil && stub.Creator.key != nil {
+		if sp.Signature, err = stub.Creator.Sign(propBytes); err != nil {
+			return nil, err
+		}
+	}
+	return sp, nil
+}
+
+// GetCreator overrides the same function in MockStub that did not implement anything
+func (stub *MockStubExtend) GetCreator() ([]byte, error) {
+	if stub.Creator == nil {
+		return nil, nil
+	}
+	return stub.Creator.Serialize()
+}
+
+// GetBinding overrides the same function in MockStub that did not implement anything
+func (stub *MockStubExtend) GetBinding() ([]byte, error) {
+	return stub.binding, nil
+}
+
+// GetDecorations overrides the same function in MockStub. It returns the decorations that the Decorators
+// of the stub added to the chaincode input of the running transaction, they are not part of its proposal.
+func (stub *MockStubExtend) GetDecorations() map[string][]byte {
+	return stub.decorations
+}
+
+// GetTransient override this function from MockStub that did not implement anything.
+func (stub *MockStubExtend) GetTransient() (map[string][]byte, error) {
+	return stub.transient, nil
+}
+
+// GetSignedProposal override this function from MockStub
+func (stub *MockStubExtend) GetSignedProposal() (*pb.SignedProposal, error) {
+	return stub.signedProposal, nil
+}
+
+// GetArgs override this function from MockStub
+func (stub *MockStubExtend) GetArgs() [][]byte {
+	return stub.args
+}
+
 // GetFunctionAndParameters Override this function from MockStub
 func (stub *MockStubExtend) GetFunctionAndParameters() (function string, params []string) {
 	allargs := stub.GetStringArgs()
@@ -124,6 +352,16 @@ func (stub *MockStubExtend) GetStringArgs() []string {
 
 // PutState writes the specified `value` and `key` into the ledger.
 func (stub *MockStubExtend) PutState(key string, value []byte) error {
+	if err := stub.fault(OpPutState, key); err != nil {
+		return err
+	}
+	stub.recordWrite(key)
+	stub.countWrite(value)
+	return stub.putState(key, value)
+}
+
+// putState writes the value of a key without adding it to the write set of the running transaction
+func (stub *MockStubExtend) putState(key string, value []byte) error {
 	// In case we are using CouchDB, we store the value document in the database
 	if stub.CouchDB {
 		return stub.DbHandler.SaveDocument(key, value)
@@ -134,6 +372,17 @@ func (stub *MockStubExtend) PutState(key string, value []byte) error {
 
 // GetState retrieves the value for a given key from the ledger
 func (stub *MockStubExtend) GetState(key string) ([]byte, error) {
+	if err := stub.fault(OpGetState, key); err != nil {
+		return nil, err
+	}
+	stub.recordRead(key)
+	value, err := stub.getState(key)
+	stub.countRead(value)
+	return value, err
+}
+
+// getState reads the value of a key without adding it to the read set of the running transaction
+func (stub *MockStubExtend) getState(key string) ([]byte, error) {
 	// In case we are using CouchDB, we store the value document in the database
 	if stub.CouchDB {
 		return stub.DbHandler.ReadDocument(key)
@@ -142,6 +391,122 @@ func (stub *MockStubExtend) GetState(key string) ([]byte, error) {
 	return stub.GetStateOriginal(key)
 }
 
+// DelState removes the key and its metadata from the ledger
+func (stub *MockStubExtend) DelState(key string) error {
+	if err := stub.fault(OpDelState, key); err != nil {
+		return err
+	}
+	stub.recordWrite(key)
+	stub.countDelete()
+	return stub.delState(key)
+}
+
+// delState removes a key without adding it to the write set of the running transaction
+func (stub *MockStubExtend) delState(key string) error {
+	if stub.CouchDB {
+		return stub.DbHandler.DeleteDocument(key)
+	}
+	delete(stub.EndorsementPolicies[""], key)
+	return stub.MockStub.DelState(key)
+}
+
+// SetStateValidationParameter sets the key-level endorsement policy of `key`.
+// The policy is kept in the metadata next to the state, so like on a peer it is
+// dropped if the key does not exist and removed when the key is deleted.
+func (stub *MockStubExtend) SetStateValidationParameter(key string, ep []byte) error {
+	if err := stub.fault(OpSetStateValidationParameter, key); err != nil {
+		return err
+	}
+	value, err := stub.getState(key)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		mockLogger.Warningf("SetStateValidationParameter ignored because key %s does not exist", key)
+		return nil
+	}
+
+	stub.recordMetadataWrite(key)
+	return stub.setStateValidationParameter(key, ep)
+}
+
+// setStateValidationParameter sets the policy of an existing key without adding it to the write set of the running transaction
+func (stub *MockStubExtend) setStateValidationParameter(key string, ep []byte) error {
+	if stub.CouchDB {
+		metadata, err := stub.DbHandler.ReadDocumentMetadata(key)
+		if err != nil {
+			return err
+		}
+		if metadata == nil {
+			metadata = make(map[string][]byte)
+		}
+		metadata[pb.MetaDataKeys_VALIDATION_PARAMETER.String()] = ep
+		return stub.DbHandler.SaveDocumentMetadata(key, metadata)
+	}
+	return stub.MockStub.SetStateValidationParameter(key, ep)
+}
+
+// GetStateValidationParameter retrieves the key-level endorsement policy of `key`
+func (stub *MockStubExtend) GetStateValidationParameter(key string) ([]byte, error) {
+	if err := stub.fault(OpGetStateValidationParameter, key); err != nil {
+		return nil, err
+	}
+	stub.recordRead(key)
+	return stub.getStateValidationParameter(key)
+}
+
+// getStateValidationParameter reads the policy of a key without adding it to the read set of the running transaction
+func (stub *MockStubExtend) getStateValidationParameter(key string) ([]byte, error) {
+	if stub.CouchDB {
+		metadata, err := stub.DbHandler.ReadDocumentMetadata(key)
+		if err != nil {
+			return nil, err
+		}
+		return metadata[pb.MetaDataKeys_VALIDATION_PARAMETER.String()], nil
+	}
+	return stub.MockStub.GetStateValidationParameter(key)
+}
+
+// GetPrivateData retrieves the value of a private key from the in-memory private state
+func (stub *MockStubExtend) GetPrivateData(collection string, key string) ([]byte, error) {
+	if err := stub.fault(OpGetPrivateData, key); err != nil {
+		return nil, err
+	}
+	stub.recordPrivateDataRead(collection, key)
+	value, err := stub.MockStub.GetPrivateData(collection, key)
+	stub.countPrivateDataRead(value)
+	return value, err
+}
+
+// GetPrivateDataHash overrides the same function in MockStub that did not implement anything
+func (stub *MockStubExtend) GetPrivateDataHash(collection, key string) ([]byte, error) {
+	value := stub.PvtState[collection][key]
+	if value == nil {
+		return nil, nil
+	}
+	return computeHash(value), nil
+}
+
+// PutPrivateData writes a private key into the in-memory private state
+func (stub *MockStubExtend) PutPrivateData(collection string, key string, value []byte) error {
+	if err := stub.fault(OpPutPrivateData, key); err != nil {
+		return err
+	}
+	stub.recordPrivateDataWrite(collection, key)
+	stub.countPrivateDataWrite(value)
+	return stub.MockStub.PutPrivateData(collection, key, value)
+}
+
+// DelPrivateData overrides the same function in MockStub that did not implement anything
+func (stub *MockStubExtend) DelPrivateData(collection string, key string) error {
+	if err := stub.fault(OpDelPrivateData, key); err != nil {
+		return err
+	}
+	stub.recordPrivateDataWrite(collection, key)
+	delete(stub.PvtState[collection], key)
+	return nil
+}
+
 // GetStateOriginal is copied from mockstub as we still need to carry on normal GetState operation with the mock ledger map
 func (stub *MockStubExtend) GetStateOriginal(key string) ([]byte, error) {
 	value := stub.State[key]
@@ -160,7 +525,7 @@ func (stub *MockStubExtend) putStateOriginal(key string, value []byte) error {
 	// If the value is nil or empty, delete the key
 	if len(value) == 0 {
 		mockLogger.Debug("MockStub", stub.Name, "PutState called, but value is nil or empty. Delete ", key)
-		return stub.DelState(key)
+		return stub.delState(key)
 	}
 
 	mockLogger.Debug("MockStub", stub.Name, "Putting", key, value)
@@ -201,39 +566,92 @@ func (stub *MockStubExtend) putStateOriginal(key string, value []byte) error {
 
 // GetStateByPartialCompositeKey queries couchdb by range
 func (stub *MockStubExtend) GetStateByPartialCompositeKey(objectType string, attributes []string) (StateQueryIteratorInterface, error) {
-	startKey, _ := stub.CreateCompositeKey(objectType, attributes)
-	endKey := startKey + string(maxUnicodeRuneValue)
-
-	rs, er := stub.DbHandler.QueryDocumentByRange(startKey, endKey)
+	startKey, er := stub.CreateCompositeKey(objectType, attributes)
 	if er != nil {
 		return nil, er
 	}
+	if err := stub.fault(OpGetStateByPartialCompositeKey, startKey); err != nil {
+		return nil, err
+	}
+	endKey := startKey + string(maxUnicodeRuneValue)
+	return stub.getStateByRange(startKey, endKey)
+}
 
-	iterator, er := FromResultsIterator(rs)
-	if er != nil {
-		return nil, er
+// GetStateByRange overrides the same function in MockStub so that it also works with couchdb
+func (stub *MockStubExtend) GetStateByRange(startKey, endKey string) (StateQueryIteratorInterface, error) {
+	if err := stub.fault(OpGetStateByRange, startKey); err != nil {
+		return nil, err
 	}
+	return stub.getStateByRange(startKey, endKey)
+}
 
+// getStateByRange returns the keys between startKey (included) and endKey (excluded).
+// An empty endKey means there is no upper bound.
+func (stub *MockStubExtend) getStateByRange(startKey, endKey string) (*AkcQueryIterator, error) {
+	iterator, err := stub.queryRange(startKey, endKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	stub.recordRangeQuery(startKey, endKey, iterator, true)
+	stub.countRangeScan(iterator)
 	return iterator, nil
 }
 
-// GetStateByPartialCompositeKeyWithPagination queries couchdb with a partial compositekey and pagination information
-//func (stub *MockStubExtend) GetStateByPartialCompositeKeyWithPagination(objectType string, attributes []string, pageSize int32, bookmark string) (StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
-//	startKey, _ := stub.CreateCompositeKey(objectType, attributes)
-//	endKey := startKey + string(maxUnicodeRuneValue)
-//
-//	rs, er := stub.DbHandler.QueryDocumentByRangeWithPagination(startKey, endKey, pageSize, bookmark)
-//	if er != nil{
-//		return nil, nil, er
-//	}
-//
-//	iterator, er := FromResultsIterator(rs)
-//	if er != nil{
-//		return nil, nil, er
-//	}
-//
-//	bm := rs.(statedb.QueryResultsIterator).GetBookmarkAndClose()
-//	queryResponse := &pb.QueryResponseMetadata{FetchedRecordsCount: int32(iterator.Length()), Bookmark: bm}
-//
-//	return iterator, queryResponse, nil
-//}
+// queryRange reads at most limit keys between startKey (included) and endKey (excluded) without recording the read,
+// all of them if limit is 0
+func (stub *MockStubExtend) queryRange(startKey, endKey string, limit int32) (*AkcQueryIterator, error) {
+	if stub.CouchDB {
+		rs, er := stub.DbHandler.QueryDocumentByRangeWithLimit(startKey, endKey, limit)
+		if er != nil {
+			return nil, er
+		}
+		return FromResultsIterator(rs)
+	}
+
+	data := make([]*couchdb.QueryResult, 0)
+	for elem := stub.Keys.Front(); elem != nil && (limit == 0 || len(data) < int(limit)); elem = elem.Next() {
+		key := elem.Value.(string)
+		if key >= startKey && (endKey == "" || key < endKey) {
+			data = append(data, &couchdb.QueryResult{ID: key, Value: stub.State[key]})
+		}
+	}
+	return &AkcQueryIterator{data: data}, nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination overrides the same function in MockStub that did not implement anything.
+// It returns at most pageSize keys starting at bookmark, and the bookmark of the next page is the key that follows
+// them, or an empty bookmark on the last page. An empty bookmark starts from the first key.
+func (stub *MockStubExtend) GetStateByPartialCompositeKeyWithPagination(objectType string, attributes []string,
+	pageSize int32, bookmark string) (StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	startKey, er := stub.CreateCompositeKey(objectType, attributes)
+	if er != nil {
+		return nil, nil, er
+	}
+	if err := stub.fault(OpGetStateByPartialCompositeKeyWithPagination, startKey); err != nil {
+		return nil, nil, err
+	}
+	if pageSize <= 0 {
+		return nil, nil, fmt.Errorf("page size %d is not positive", pageSize)
+	}
+	endKey := startKey + string(maxUnicodeRuneValue)
+	if bookmark != "" {
+		if bookmark < startKey || bookmark >= endKey {
+			return nil, nil, fmt.Errorf("bookmark %s is not a key of the range", readableKey(bookmark))
+		}
+		startKey = bookmark
+	}
+
+	// one more key than the page tells whether there is a next page and where it starts
+	iterator, er := stub.queryRange(startKey, endKey, pageSize+1)
+	if er != nil {
+		return nil, nil, er
+	}
+	next := ""
+	if len(iterator.data) > int(pageSize) {
+		next = iterator.data[pageSize].ID
+		iterator.data = iterator.data[:pageSize]
+	}
+	stub.recordRangeQuery(startKey, endKey, iterator, next == "")
+	stub.countRangeScan(iterator)
+	return iterator, &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(iterator.data)), Bookmark: next}, nil
+}
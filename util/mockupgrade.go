@@ -0,0 +1,39 @@
+package util
+
+import (
+	"github.com/golang/protobuf/ptypes/timestamp"
+	. "github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// MockUpgrade upgrades the chaincode of the stub to cc on the same state. version identifies cc, e.g. "v2",
+// it is recorded so that Replay can run the upgrade with the same chaincode. Like an upgrade on Fabric 1.4,
+// Init of the new chaincode is called with args so that it can migrate the data of the previous version.
+// If Init fails, the upgrade is rolled back: the previous chaincode stays and what Init wrote is discarded.
+func (stub *MockStubExtend) MockUpgrade(uuid string, version string, cc Chaincode, args [][]byte) pb.Response {
+	// A failed upgrade is rolled back outside of the transaction, which resets the timestamp of the stub
+	txTimestamp := stub.nextTxTimestamp()
+	res := stub.upgrade(uuid, cc, args, nil, txTimestamp)
+	if tx := stub.record(RecordedUpgrade, uuid, args, nil, txTimestamp, res); tx != nil {
+		tx.Chaincode = version
+	}
+	return res
+}
+
+// upgrade swaps in cc and calls its Init, the previous chaincode is put back if Init fails
+func (stub *MockStubExtend) upgrade(uuid string, cc Chaincode, args [][]byte, transient map[string][]byte,
+	txTimestamp *timestamp.Timestamp) pb.Response {
+	previous := stub.cc
+	stub.cc = cc
+	res := stub.mockTransaction(uuid, args, transient, txTimestamp, cc.Init)
+	if res.Status < ERRORTHRESHOLD {
+		return res
+	}
+
+	mockLogger.Warningf("MockUpgrade rolled back because Init of transaction %s failed: %s", uuid, res.Message)
+	stub.cc = previous
+	if err := stub.rollbackLastTransaction(); err != nil {
+		mockLogger.Errorf("MockUpgrade failed to discard the writes of transaction %s: %v", uuid, err)
+	}
+	return res
+}
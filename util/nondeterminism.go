@@ -0,0 +1,75 @@
+package util
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// DetectNonDeterminism makes every MockInvoke run twice, each time on a copy of the state from before the transaction.
+// Both runs get the same TxID, transaction timestamp and injected faults, like the endorsers of a transaction do.
+// What differs between endorsers differs between the runs: the second run sees a later wall clock and runs on
+// several threads while the first runs on a single one, and Go iterates maps in a different order on every run.
+// Any difference between the responses or write sets of both runs is reported to t as a test failure.
+// Pass nil to turn the detector off.
+func (stub *MockStubExtend) DetectNonDeterminism(t testing.TB) {
+	stub.nonDeterminismT = t
+}
+
+// mockInvokeTwice invokes the chaincode a first time, restores the state and the injected faults,
+// then invokes it again and compares both runs. The second run is the one that stays committed.
+func (stub *MockStubExtend) mockInvokeTwice(uuid string, args [][]byte, transient map[string][]byte,
+	txTimestamp *timestamp.Timestamp) pb.Response {
+	t := stub.nonDeterminismT
+
+	snapshot, err := stub.takeSnapshot()
+	if err != nil {
+		t.Errorf("non-determinism detector could not copy the state before transaction %s: %v", uuid, err)
+		return stub.mockTransaction(uuid, args, transient, txTimestamp, stub.cc.Invoke)
+	}
+	faultCalls := make([]int, len(stub.faults))
+	for i, f := range stub.faults {
+		faultCalls[i] = f.calls
+	}
+
+	procs := runtime.GOMAXPROCS(1)
+	first := stub.mockTransaction(uuid, args, transient, txTimestamp, stub.cc.Invoke)
+	runtime.GOMAXPROCS(procs)
+	if stub.lastTx == nil {
+		t.Errorf("non-determinism detector could not run transaction %s: %s", uuid, first.Message)
+		return stub.mockTransaction(uuid, args, transient, txTimestamp, stub.cc.Invoke)
+	}
+	firstWrites := stub.lastTxWrittenState()
+	if err := stub.restoreSnapshot(snapshot); err != nil {
+		t.Errorf("non-determinism detector could not restore the state before transaction %s: %v", uuid, err)
+		return first
+	}
+	// The first run must not use up the calls after which the faults fire
+	for i, f := range stub.faults {
+		if i < len(faultCalls) {
+			f.calls = faultCalls[i]
+		}
+	}
+
+	// Make sure the second run does not see the same wall clock and runs on several threads
+	time.Sleep(time.Millisecond)
+	if procs < 2 {
+		runtime.GOMAXPROCS(2)
+		defer runtime.GOMAXPROCS(procs)
+	}
+	second := stub.mockTransaction(uuid, args, transient, txTimestamp, stub.cc.Invoke)
+	secondWrites := stub.lastTxWrittenState()
+
+	if first.Status != second.Status || first.Message != second.Message || !bytes.Equal(first.Payload, second.Payload) {
+		t.Errorf("transaction %s is non-deterministic: first run responded %d %q, second run responded %d %q",
+			uuid, first.Status, first.Payload, second.Status, second.Payload)
+	}
+	if keys := diffWriteSets(firstWrites, secondWrites); len(keys) > 0 {
+		t.Errorf("transaction %s is non-deterministic: write sets differ on keys %q", uuid, keys)
+	}
+	return second
+}
@@ -0,0 +1,244 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	. "github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Kinds of recorded transactions
+const (
+	RecordedInit    = "init"
+	RecordedInvoke  = "invoke"
+	RecordedQuery   = "query"
+	RecordedUpgrade = "upgrade"
+)
+
+// RecordedWrite is a key written by a recorded transaction, Value is nil if the key was deleted
+type RecordedWrite struct {
+	Key                 string `json:"key"`
+	Value               []byte `json:"value,omitempty"`
+	IsDelete            bool   `json:"isDelete,omitempty"`
+	ValidationParameter []byte `json:"validationParameter,omitempty"`
+}
+
+// RecordedTransaction is a MockInit, MockInvoke, MockQuery or MockUpgrade call along with its outcome
+type RecordedTransaction struct {
+	Kind      string               `json:"kind"`
+	TxID      string               `json:"txID"`
+	Chaincode string               `json:"chaincode,omitempty"` // version of the chaincode installed by an upgrade
+	Args      [][]byte             `json:"args"`
+	Transient map[string][]byte    `json:"transient,omitempty"`
+	Creator   []byte               `json:"creator,omitempty"` // serialized identity of the creator
+	Timestamp *timestamp.Timestamp `json:"timestamp"`
+	Response  pb.Response          `json:"response"`
+	Writes    []*RecordedWrite     `json:"writes"`
+}
+
+// TxRecording is a log of transactions that can be saved to a file and replayed against another chaincode build
+type TxRecording struct {
+	Transactions []*RecordedTransaction `json:"transactions"`
+}
+
+// NewTxRecording creates an empty recording
+func NewTxRecording() *TxRecording {
+	return &TxRecording{Transactions: make([]*RecordedTransaction, 0)}
+}
+
+// LoadTxRecording reads a recording saved with Save
+func LoadTxRecording(path string) (*TxRecording, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadTxRecording failed because ioutil.ReadFile failed with error %v", err)
+	}
+	recording := NewTxRecording()
+	if err := json.Unmarshal(content, recording); err != nil {
+		return nil, fmt.Errorf("LoadTxRecording failed because json.Unmarshal failed with error %v", err)
+	}
+	return recording, nil
+}
+
+// Save writes the recording to a JSON file
+func (recording *TxRecording) Save(path string) error {
+	content, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Save failed because json.MarshalIndent failed with error %v", err)
+	}
+	return ioutil.WriteFile(path, append(content, '\n'), 0644)
+}
+
+// Record makes the stub append every MockInit, MockInvoke, MockQuery and MockUpgrade call to recording.
+// Pass nil to stop recording.
+func (stub *MockStubExtend) Record(recording *TxRecording) {
+	stub.recording = recording
+}
+
+// record appends the transaction that has just been committed with txTimestamp to the recording,
+// if there is one, and returns the recorded transaction
+func (stub *MockStubExtend) record(kind string, uuid string, args [][]byte, transient map[string][]byte,
+	txTimestamp *timestamp.Timestamp, res pb.Response) *RecordedTransaction {
+	if stub.recording == nil || stub.lastTx == nil || stub.lastTx.txID != uuid {
+		return nil
+	}
+	tx := &RecordedTransaction{
+		Kind:      kind,
+		TxID:      uuid,
+		Args:      args,
+		Transient: transient,
+		Timestamp: txTimestamp,
+		Response:  res,
+		Writes:    recordedWrites(stub.lastRWSet.after),
+	}
+	if stub.Creator != nil {
+		tx.Creator, _ = stub.Creator.Serialize()
+	}
+	stub.recording.Transactions = append(stub.recording.Transactions, tx)
+	return tx
+}
+
+// recordedWrites lists the state of the written keys in key order
+func recordedWrites(writes txWriteSet) []*RecordedWrite {
+	recorded := make([]*RecordedWrite, 0, len(writes))
+	for _, key := range sortedKeys(writes) {
+		state := writes[key]
+		recorded = append(recorded, &RecordedWrite{
+			Key:                 key,
+			Value:               state.value,
+			IsDelete:            state.value == nil,
+			ValidationParameter: state.validationParameter,
+		})
+	}
+	return recorded
+}
+
+// Replay runs the recorded transactions, in order and with the same transaction IDs, arguments, transient maps,
+// creators and timestamps, against the chaincode of stub. Upgrades swap in the chaincode that upgrades gives
+// for the recorded version. It returns every difference between the recorded and the replayed responses and
+// write sets. The creators are replayed without their private key, so proposals are not signed unless the
+// stub's Creator is the recorded one.
+func (recording *TxRecording) Replay(stub *MockStubExtend, upgrades map[string]Chaincode) ([]string, error) {
+	creator := stub.Creator
+	defer func() { stub.Creator = creator }()
+
+	divergences := make([]string, 0)
+	for i, tx := range recording.Transactions {
+		if err := stub.replayCreator(creator, tx.Creator); err != nil {
+			return divergences, fmt.Errorf("Replay failed because the creator of transaction %s is invalid: %v", tx.TxID, err)
+		}
+
+		var res pb.Response
+		switch tx.Kind {
+		case RecordedInit:
+			res = stub.mockTransaction(tx.TxID, tx.Args, tx.Transient, tx.Timestamp, stub.cc.Init)
+		case RecordedInvoke, RecordedQuery:
+			res = stub.mockTransaction(tx.TxID, tx.Args, tx.Transient, tx.Timestamp, stub.cc.Invoke)
+		case RecordedUpgrade:
+			cc, ok := upgrades[tx.Chaincode]
+			if !ok {
+				return divergences, fmt.Errorf("Replay failed because no chaincode was given for version %q of upgrade %s",
+					tx.Chaincode, tx.TxID)
+			}
+			res = stub.upgrade(tx.TxID, cc, tx.Args, tx.Transient, tx.Timestamp)
+		default:
+			return divergences, fmt.Errorf("Replay failed because transaction %s has unknown kind %s", tx.TxID, tx.Kind)
+		}
+		writes := make([]*RecordedWrite, 0)
+		if stub.lastTx != nil && stub.lastTx.txID == tx.TxID {
+			writes = recordedWrites(stub.lastRWSet.after)
+		}
+		if tx.Kind == RecordedQuery && len(writes) > 0 {
+			if err := stub.rollbackLastTransaction(); err != nil {
+				return divergences, fmt.Errorf("Replay failed because query %s could not be rolled back: %v", tx.TxID, err)
+			}
+		}
+
+		for _, d := range compareReplay(tx, res, writes) {
+			divergences = append(divergences, fmt.Sprintf("transaction %d (%s %s): %s", i, tx.Kind, tx.TxID, d))
+		}
+	}
+	return divergences, nil
+}
+
+// replayCreator sets the Creator of the stub to the recorded one
+func (stub *MockStubExtend) replayCreator(creator *MockIdentity, recorded []byte) error {
+	if len(recorded) == 0 {
+		stub.Creator = nil
+		return nil
+	}
+	if creator != nil {
+		if serialized, err := creator.Serialize(); err == nil && bytes.Equal(serialized, recorded) {
+			stub.Creator = creator
+			return nil
+		}
+	}
+	identity, err := deserializeMockIdentity(recorded)
+	if err != nil {
+		return err
+	}
+	stub.Creator = identity
+	return nil
+}
+
+// compareReplay describes how a replayed transaction differs from its recording
+func compareReplay(tx *RecordedTransaction, res pb.Response, writes []*RecordedWrite) []string {
+	divergences := make([]string, 0)
+	if tx.Response.Status != res.Status || tx.Response.Message != res.Message || !bytes.Equal(tx.Response.Payload, res.Payload) {
+		divergences = append(divergences, fmt.Sprintf("response was %d %q %q, replay responded %d %q %q",
+			tx.Response.Status, tx.Response.Message, tx.Response.Payload, res.Status, res.Message, res.Payload))
+	}
+
+	recorded := make(map[string]*RecordedWrite)
+	for _, w := range tx.Writes {
+		recorded[w.Key] = w
+	}
+	replayed := make(map[string]*RecordedWrite)
+	for _, w := range writes {
+		replayed[w.Key] = w
+		r, ok := recorded[w.Key]
+		switch {
+		case !ok:
+			divergences = append(divergences, fmt.Sprintf("replay wrote key %s that was not written", readableKey(w.Key)))
+		case r.IsDelete != w.IsDelete || !bytes.Equal(r.Value, w.Value):
+			divergences = append(divergences, fmt.Sprintf("key %s was written %s, replay wrote %s",
+				readableKey(w.Key), recordedValue(r), recordedValue(w)))
+		case !bytes.Equal(r.ValidationParameter, w.ValidationParameter):
+			divergences = append(divergences, fmt.Sprintf("key-level endorsement policy of key %s differs", readableKey(w.Key)))
+		}
+	}
+	for _, w := range tx.Writes {
+		if _, ok := replayed[w.Key]; !ok {
+			divergences = append(divergences, fmt.Sprintf("replay did not write key %s", readableKey(w.Key)))
+		}
+	}
+	return divergences
+}
+
+func recordedValue(w *RecordedWrite) string {
+	if w.IsDelete {
+		return "(deleted)"
+	}
+	return fmt.Sprintf("%q", w.Value)
+}
+
+// AssertReplay replays the recording saved at path against the chaincode of stub, upgrading it to the
+// chaincodes of upgrades by version, and reports every divergence to t as a test failure
+func AssertReplay(t testing.TB, stub *MockStubExtend, path string, upgrades map[string]Chaincode) {
+	t.Helper()
+	recording, err := LoadTxRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	divergences, err := recording.Replay(stub, upgrades)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range divergences {
+		t.Errorf("replay of %s diverged: %s", path, d)
+	}
+}
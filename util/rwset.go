@@ -0,0 +1,462 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// keyState is the value of a key along with its key-level endorsement policy and version
+type keyState struct {
+	value               []byte
+	validationParameter []byte
+	version             *kvrwset.Version
+}
+
+// txWriteSet keeps the keys written by a transaction along with their state from before the transaction
+type txWriteSet map[string]*keyState
+
+// txSimulation keeps track of what a mock transaction reads and writes
+type txSimulation struct {
+	txID           string
+	reads          map[string]*kvrwset.Version // version of each key when it was first read, nil if it did not exist
+	writes         txWriteSet                  // keys whose value or metadata was written
+	valueWrites    map[string]bool             // keys whose value was written or deleted
+	metadataWrites map[string]bool             // keys whose metadata was written
+	rangeQueries   []*kvrwset.RangeQueryInfo
+	pvtReads       map[string]map[string]*kvrwset.Version // private data reads, by collection
+	pvtWrites      map[string]txWriteSet                  // private data writes with their previous state, by collection
+	cost           TxCost                                 // what the transaction asked of the ledger
+}
+
+func newTxSimulation(txID string) *txSimulation {
+	return &txSimulation{
+		txID:           txID,
+		reads:          make(map[string]*kvrwset.Version),
+		writes:         make(txWriteSet),
+		valueWrites:    make(map[string]bool),
+		metadataWrites: make(map[string]bool),
+		pvtReads:       make(map[string]map[string]*kvrwset.Version),
+		pvtWrites:      make(map[string]txWriteSet),
+	}
+}
+
+// TxRWSet is the read/write set of a mock transaction
+type TxRWSet struct {
+	TxID             string
+	PubRWSet         *kvrwset.KVRWSet                // public state read and written
+	CollHashedRWSets map[string]*kvrwset.HashedRWSet // hashes of the private data read and written, by collection
+	before           txWriteSet                      // state of the written keys before the transaction
+	after            txWriteSet                      // state of the written keys after the transaction
+}
+
+// LastTxRWSet returns the read/write set of the last mock transaction
+func (stub *MockStubExtend) LastTxRWSet() *TxRWSet {
+	return stub.lastRWSet
+}
+
+// WrittenKeys returns the sorted keys whose value was written or deleted
+func (rwset *TxRWSet) WrittenKeys() []string {
+	keys := make([]string, 0, len(rwset.PubRWSet.Writes))
+	for _, w := range rwset.PubRWSet.Writes {
+		keys = append(keys, w.Key)
+	}
+	return keys
+}
+
+// ReadKeys returns the sorted keys that were read, range queries excluded
+func (rwset *TxRWSet) ReadKeys() []string {
+	keys := make([]string, 0, len(rwset.PubRWSet.Reads))
+	for _, r := range rwset.PubRWSet.Reads {
+		keys = append(keys, r.Key)
+	}
+	return keys
+}
+
+// String returns the read/write set as a readable diff
+func (rwset *TxRWSet) String() string {
+	return rwset.Diff()
+}
+
+// Diff returns the read/write set in a readable form, showing the old and new value of every key written.
+// Composite keys are shown as objectType(attribute1,attribute2,...)
+func (rwset *TxRWSet) Diff() string {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "transaction %s\n", rwset.TxID)
+	for _, r := range rwset.PubRWSet.Reads {
+		fmt.Fprintf(&buffer, "read     %s %s\n", readableKey(r.Key), readableVersion(r.Version))
+	}
+	for _, q := range rwset.PubRWSet.RangeQueriesInfo {
+		if q.EndKey == q.StartKey+string(maxUnicodeRuneValue) {
+			fmt.Fprintf(&buffer, "range    prefix %s, %d keys\n", readableKey(q.StartKey), len(q.GetRawReads().GetKvReads()))
+		} else {
+			fmt.Fprintf(&buffer, "range    %s to %s, %d keys\n", readableKey(q.StartKey), readableKey(q.EndKey), len(q.GetRawReads().GetKvReads()))
+		}
+		for _, r := range q.GetRawReads().GetKvReads() {
+			fmt.Fprintf(&buffer, "         %s %s\n", readableKey(r.Key), readableVersion(r.Version))
+		}
+	}
+	for _, w := range rwset.PubRWSet.Writes {
+		before := rwset.before[w.Key]
+		if w.IsDelete {
+			fmt.Fprintf(&buffer, "delete   %s\n", readableKey(w.Key))
+		} else {
+			fmt.Fprintf(&buffer, "write    %s\n", readableKey(w.Key))
+		}
+		if before != nil && before.value != nil {
+			fmt.Fprintf(&buffer, "  - %s\n", before.value)
+		}
+		if !w.IsDelete {
+			fmt.Fprintf(&buffer, "  + %s\n", w.Value)
+		}
+	}
+	for _, m := range rwset.PubRWSet.MetadataWrites {
+		names := make([]string, 0, len(m.Entries))
+		for _, e := range m.Entries {
+			names = append(names, e.Name)
+		}
+		fmt.Fprintf(&buffer, "metadata %s [%s]\n", readableKey(m.Key), strings.Join(names, " "))
+	}
+
+	collections := make([]string, 0, len(rwset.CollHashedRWSets))
+	for collection := range rwset.CollHashedRWSets {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	for _, collection := range collections {
+		hashed := rwset.CollHashedRWSets[collection]
+		for _, r := range hashed.HashedReads {
+			fmt.Fprintf(&buffer, "pvt read  %s %x %s\n", collection, r.KeyHash, readableVersion(r.Version))
+		}
+		for _, w := range hashed.HashedWrites {
+			if w.IsDelete {
+				fmt.Fprintf(&buffer, "pvt delete %s %x\n", collection, w.KeyHash)
+			} else {
+				fmt.Fprintf(&buffer, "pvt write %s %x = %x\n", collection, w.KeyHash, w.ValueHash)
+			}
+		}
+	}
+	return buffer.String()
+}
+
+// readableKey shows composite keys as objectType(attribute1,attribute2,...)
+func readableKey(key string) string {
+	objectType, attributes, ok := splitCompositeKey(key)
+	if !ok {
+		return key
+	}
+	return objectType + "(" + strings.Join(attributes, ",") + ")"
+}
+
+// splitCompositeKey is the same as SplitCompositeKey in the shim, ok is false if key is not a composite key
+func splitCompositeKey(key string) (objectType string, attributes []string, ok bool) {
+	if !strings.HasPrefix(key, compositeKeyNamespace) || !strings.HasSuffix(key, string(minUnicodeRuneValue)) {
+		return "", nil, false
+	}
+	components := strings.Split(key[len(compositeKeyNamespace):len(key)-1], string(minUnicodeRuneValue))
+	return components[0], components[1:], true
+}
+
+func readableVersion(version *kvrwset.Version) string {
+	if version == nil {
+		return "(absent)"
+	}
+	return fmt.Sprintf("(version %d:%d)", version.BlockNum, version.TxNum)
+}
+
+// recordRead adds key to the read set of the running transaction
+func (stub *MockStubExtend) recordRead(key string) {
+	if stub.tx == nil {
+		return
+	}
+	if _, ok := stub.tx.reads[key]; !ok {
+		stub.tx.reads[key] = stub.versions[key]
+	}
+}
+
+// recordRangeQuery adds a range query to the read set of the running transaction. Like on a peer, the query only
+// records the keys the chaincode goes through, and it is exhausted once the iterator has reached the end of the range.
+// complete is false if the iterator holds only part of the range, e.g. a page, the query is then never exhausted.
+func (stub *MockStubExtend) recordRangeQuery(startKey, endKey string, iterator *AkcQueryIterator, complete bool) {
+	if stub.tx == nil {
+		return
+	}
+	info := &kvrwset.RangeQueryInfo{
+		StartKey:  startKey,
+		ReadsInfo: &kvrwset.RangeQueryInfo_RawReads{RawReads: &kvrwset.QueryReads{KvReads: make([]*kvrwset.KVRead, 0)}},
+	}
+	stub.tx.rangeQueries = append(stub.tx.rangeQueries, info)
+
+	versions := make([]*kvrwset.Version, len(iterator.data))
+	for i, item := range iterator.data {
+		versions[i] = stub.versions[item.ID]
+	}
+	iterator.rangeQuery = &rangeQueryRecord{info: info, endKey: endKey, versions: versions, complete: complete}
+}
+
+// rangeQueryRecord updates the range query of a read set as the chaincode goes through its iterator
+type rangeQueryRecord struct {
+	info     *kvrwset.RangeQueryInfo
+	endKey   string
+	versions []*kvrwset.Version // version of each key of the iterator when the query ran
+	complete bool
+}
+
+// read records the key at position i of the iterator, the end of the query is the last key read
+func (record *rangeQueryRecord) read(i int, key string) {
+	reads := record.info.GetRawReads()
+	reads.KvReads = append(reads.KvReads, &kvrwset.KVRead{Key: key, Version: record.versions[i]})
+	record.info.EndKey = key
+}
+
+// exhaust records that the iterator has no more keys
+func (record *rangeQueryRecord) exhaust() {
+	if !record.complete || record.info.ItrExhausted {
+		return
+	}
+	record.info.ItrExhausted = true
+	record.info.EndKey = record.endKey
+}
+
+// recordWrite adds key to the write set of the running transaction
+func (stub *MockStubExtend) recordWrite(key string) {
+	if stub.tx == nil {
+		return
+	}
+	stub.keepPreviousState(key)
+	stub.tx.valueWrites[key] = true
+}
+
+// recordMetadataWrite adds the metadata of key to the write set of the running transaction
+func (stub *MockStubExtend) recordMetadataWrite(key string) {
+	if stub.tx == nil {
+		return
+	}
+	stub.keepPreviousState(key)
+	stub.tx.metadataWrites[key] = true
+}
+
+// keepPreviousState keeps the state of key from before the transaction,
+// the transaction is validated against its policy and rolled back to it
+func (stub *MockStubExtend) keepPreviousState(key string) {
+	if _, ok := stub.tx.writes[key]; !ok {
+		stub.tx.writes[key] = stub.readKeyState(key)
+	}
+}
+
+// recordPrivateDataRead adds a private key to the read set of the running transaction
+func (stub *MockStubExtend) recordPrivateDataRead(collection, key string) {
+	if stub.tx == nil {
+		return
+	}
+	if stub.tx.pvtReads[collection] == nil {
+		stub.tx.pvtReads[collection] = make(map[string]*kvrwset.Version)
+	}
+	if _, ok := stub.tx.pvtReads[collection][key]; !ok {
+		stub.tx.pvtReads[collection][key] = stub.pvtVersions[collection][key]
+	}
+}
+
+// recordPrivateDataWrite adds a private key to the write set of the running transaction
+func (stub *MockStubExtend) recordPrivateDataWrite(collection, key string) {
+	if stub.tx == nil {
+		return
+	}
+	if stub.tx.pvtWrites[collection] == nil {
+		stub.tx.pvtWrites[collection] = make(txWriteSet)
+	}
+	if _, ok := stub.tx.pvtWrites[collection][key]; !ok {
+		stub.tx.pvtWrites[collection][key] = &keyState{value: stub.PvtState[collection][key], version: stub.pvtVersions[collection][key]}
+	}
+}
+
+// commit ends the running transaction: the versions of the keys it wrote are bumped
+// and its read/write set is kept for inspection
+func (stub *MockStubExtend) commit() {
+	tx := stub.tx
+	stub.tx = nil
+	stub.height++
+	newVersion := &kvrwset.Version{BlockNum: stub.height, TxNum: 0}
+
+	for key := range tx.writes {
+		if value, _ := stub.getState(key); value == nil {
+			delete(stub.versions, key)
+		} else {
+			stub.versions[key] = newVersion
+		}
+	}
+	for collection, keys := range tx.pvtWrites {
+		for key := range keys {
+			if stub.pvtVersions[collection] == nil {
+				stub.pvtVersions[collection] = make(map[string]*kvrwset.Version)
+			}
+			if stub.PvtState[collection][key] == nil {
+				delete(stub.pvtVersions[collection], key)
+			} else {
+				stub.pvtVersions[collection][key] = newVersion
+			}
+		}
+	}
+
+	stub.recordHistory(tx)
+	stub.lastTx = tx
+	stub.lastRWSet = stub.buildRWSet(tx)
+}
+
+// buildRWSet builds the read/write set of a transaction that has just been committed
+func (stub *MockStubExtend) buildRWSet(tx *txSimulation) *TxRWSet {
+	rwset := &TxRWSet{
+		TxID:             tx.txID,
+		PubRWSet:         &kvrwset.KVRWSet{RangeQueriesInfo: tx.rangeQueries},
+		CollHashedRWSets: make(map[string]*kvrwset.HashedRWSet),
+		before:           tx.writes,
+		after:            stub.lastTxWrittenState(),
+	}
+
+	for _, key := range sortedKeys(tx.reads) {
+		rwset.PubRWSet.Reads = append(rwset.PubRWSet.Reads, &kvrwset.KVRead{Key: key, Version: tx.reads[key]})
+	}
+	for _, key := range sortedKeys(tx.valueWrites) {
+		value := rwset.after[key].value
+		rwset.PubRWSet.Writes = append(rwset.PubRWSet.Writes, &kvrwset.KVWrite{Key: key, IsDelete: value == nil, Value: value})
+	}
+	for _, key := range sortedKeys(tx.metadataWrites) {
+		write := &kvrwset.KVMetadataWrite{Key: key}
+		if ep := rwset.after[key].validationParameter; len(ep) > 0 {
+			write.Entries = []*kvrwset.KVMetadataEntry{{Name: pb.MetaDataKeys_VALIDATION_PARAMETER.String(), Value: ep}}
+		}
+		rwset.PubRWSet.MetadataWrites = append(rwset.PubRWSet.MetadataWrites, write)
+	}
+
+	for collection, reads := range tx.pvtReads {
+		hashed := rwset.collHashedRWSet(collection)
+		for _, key := range sortedKeys(reads) {
+			hashed.HashedReads = append(hashed.HashedReads, &kvrwset.KVReadHash{KeyHash: computeHash([]byte(key)), Version: reads[key]})
+		}
+	}
+	for collection, writes := range tx.pvtWrites {
+		hashed := rwset.collHashedRWSet(collection)
+		for _, key := range sortedKeys(writes) {
+			write := &kvrwset.KVWriteHash{KeyHash: computeHash([]byte(key))}
+			if value := stub.PvtState[collection][key]; value == nil {
+				write.IsDelete = true
+			} else {
+				write.ValueHash = computeHash(value)
+			}
+			hashed.HashedWrites = append(hashed.HashedWrites, write)
+		}
+	}
+	return rwset
+}
+
+func (rwset *TxRWSet) collHashedRWSet(collection string) *kvrwset.HashedRWSet {
+	hashed, ok := rwset.CollHashedRWSets[collection]
+	if !ok {
+		hashed = new(kvrwset.HashedRWSet)
+		rwset.CollHashedRWSets[collection] = hashed
+	}
+	return hashed
+}
+
+// sortedKeys returns the keys of a map[string]T in order
+func sortedKeys(m interface{}) []string {
+	keys := make([]string, 0)
+	switch t := m.(type) {
+	case map[string]bool:
+		for key := range t {
+			keys = append(keys, key)
+		}
+	case txWriteSet:
+		for key := range t {
+			keys = append(keys, key)
+		}
+	case map[string]*kvrwset.Version:
+		for key := range t {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func computeHash(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// readKeyState returns the current value, key-level endorsement policy and version of key
+func (stub *MockStubExtend) readKeyState(key string) *keyState {
+	value, _ := stub.getState(key)
+	ep, _ := stub.getStateValidationParameter(key)
+	return &keyState{value: value, validationParameter: ep, version: stub.versions[key]}
+}
+
+// writeKeyState sets the value, key-level endorsement policy and version of key outside of any chaincode transaction
+func (stub *MockStubExtend) writeKeyState(key string, state *keyState) error {
+	txID := genTxID()
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+
+	if state.version == nil {
+		delete(stub.versions, key)
+	} else {
+		stub.versions[key] = state.version
+	}
+
+	if state.value == nil {
+		return stub.delState(key)
+	}
+	if err := stub.putState(key, state.value); err != nil {
+		return err
+	}
+	current, err := stub.getStateValidationParameter(key)
+	if err != nil {
+		return err
+	}
+	if len(current) == 0 && len(state.validationParameter) == 0 {
+		return nil
+	}
+	return stub.setStateValidationParameter(key, state.validationParameter)
+}
+
+// lastTxWrittenState returns the current state of the keys written by the last transaction
+func (stub *MockStubExtend) lastTxWrittenState() txWriteSet {
+	writes := make(txWriteSet)
+	if stub.lastTx == nil {
+		return writes
+	}
+	for key := range stub.lastTx.writes {
+		writes[key] = stub.readKeyState(key)
+	}
+	return writes
+}
+
+// rollbackLastTransaction restores the keys written by the last transaction to their previous state
+func (stub *MockStubExtend) rollbackLastTransaction() error {
+	if stub.lastTx == nil {
+		return nil
+	}
+	for key, old := range stub.lastTx.writes {
+		if err := stub.writeKeyState(key, old); err != nil {
+			return err
+		}
+	}
+	for collection, keys := range stub.lastTx.pvtWrites {
+		for key, old := range keys {
+			if old.value == nil {
+				delete(stub.PvtState[collection], key)
+				delete(stub.pvtVersions[collection], key)
+			} else {
+				stub.PvtState[collection][key] = old.value
+				stub.pvtVersions[collection][key] = old.version
+			}
+		}
+	}
+	stub.rollbackHistory(stub.lastTx)
+	return nil
+}
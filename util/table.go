@@ -0,0 +1,424 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// tagName is the struct tag that declares the schema of a table:
+//
+//	type Data struct {
+//		_          struct{} `akc:"table,Data_"`
+//		Key1       string   `akc:"key,1"`
+//		Key2       string   `akc:"key,2"`
+//		Attribute1 string   `akc:"index,byAttribute1"`
+//	}
+//
+// A tag holds directives separated by ';', each made of a name and its comma separated arguments.
+const tagName = "akc"
+
+// Table is the schema of a table declared with struct tags: its name and its ordered key fields.
+// Rows are stored with the table functions of this package, so their composite keys are the same
+// as if InsertTableRow had been given the table name and the key fields in order.
+type Table struct {
+	Name         string       // table name, the object type of the composite keys
+	Keys         []string     // names of the key fields, in key order
+	rowType      reflect.Type // struct type of the rows
+	keyFields    []int        // index of the key fields, in key order
+	versionField int          // index of the version field, -1 if the rows are not versioned
+}
+
+// tagDirective is a directive of an akc struct tag, e.g. key,1
+type tagDirective struct {
+	name string
+	args []string
+}
+
+// parseTag parses the directives of an akc struct tag
+func parseTag(tag string) []tagDirective {
+	directives := make([]tagDirective, 0)
+	for _, part := range strings.Split(tag, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		items := strings.Split(part, ",")
+		for i := range items {
+			items[i] = strings.TrimSpace(items[i])
+		}
+		directives = append(directives, tagDirective{name: items[0], args: items[1:]})
+	}
+	return directives
+}
+
+// NewTable reads the schema of a table from the struct tags of row, a struct or a pointer to a struct.
+// The table name comes from a blank field tagged akc:"table,<name>", or from a TableName() string method,
+// and the key fields are tagged akc:"key,<position>" with positions starting at 1.
+// Fields tagged akc:"index,<name>[,<position>]" make up the secondary index <name>, see DeclareIndex.
+// Fields tagged akc:"unique,<name>[,<position>]" make up the unique constraint <name>, see DeclareUniqueConstraint.
+// The validation rules required, pattern,<regexp>, min,<n>, max,<n>, minlen,<n>, maxlen,<n> and enum,<a>|<b>
+// make up the schema of the table, see DeclareSchema, e.g. akc:"required;maxlen,64".
+// An integer field tagged akc:"version" holds the version of the rows, see DeclareVersionField.
+// The softdelete directive of the table tag, e.g. akc:"table,Invoice_;softdelete", soft deletes its rows,
+// see DeclareSoftDelete, and the audit directive stamps them, see DeclareAudit.
+// All of them are declared at once with DeclareTable: nothing is declared if one of them conflicts.
+func NewTable(row interface{}) (*Table, error) {
+	rowType := reflect.TypeOf(row)
+	for rowType != nil && rowType.Kind() == reflect.Ptr {
+		rowType = rowType.Elem()
+	}
+	if rowType == nil || rowType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("NewTable failed because %T is not a struct", row)
+	}
+
+	table := &Table{rowType: rowType, versionField: -1}
+	if named, ok := reflect.New(rowType).Interface().(interface{ TableName() string }); ok {
+		table.Name = named.TableName()
+	}
+	positions := make(map[int]int)                 // key position -> field index
+	indexFields := make(map[string]map[int]string) // index name -> position -> JSON field name
+	indexNames := make([]string, 0)
+	unique := make(map[string]bool) // index name -> unique constraint
+	schema := new(TableSchema)
+	softDelete, audit := false, false
+	for i := 0; i < rowType.NumField(); i++ {
+		field := rowType.Field(i)
+		for _, d := range parseTag(field.Tag.Get(tagName)) {
+			switch d.name {
+			case "table":
+				if len(d.args) != 1 || d.args[0] == "" {
+					return nil, fmt.Errorf("NewTable failed because the table tag of %s has no name", rowType)
+				}
+				table.Name = d.args[0]
+			case "softdelete":
+				softDelete = true
+			case "audit":
+				audit = true
+			case "key":
+				if field.PkgPath != "" {
+					return nil, fmt.Errorf("NewTable failed because key field %s of %s is not exported", field.Name, rowType)
+				}
+				if len(d.args) != 1 {
+					return nil, fmt.Errorf("NewTable failed because key field %s of %s has no position", field.Name, rowType)
+				}
+				position, err := strconv.Atoi(d.args[0])
+				if err != nil || position < 1 {
+					return nil, fmt.Errorf("NewTable failed because key field %s of %s has invalid position %s", field.Name, rowType, d.args[0])
+				}
+				if other, ok := positions[position]; ok {
+					return nil, fmt.Errorf("NewTable failed because key fields %s and %s of %s have the same position %d",
+						rowType.Field(other).Name, field.Name, rowType, position)
+				}
+				positions[position] = i
+			case "version":
+				switch field.Type.Kind() {
+				case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+				default:
+					return nil, fmt.Errorf("NewTable failed because version field %s of %s is not an integer", field.Name, rowType)
+				}
+				if table.versionField >= 0 {
+					return nil, fmt.Errorf("NewTable failed because %s has two version fields", rowType)
+				}
+				table.versionField = i
+			case "index", "unique":
+				if len(d.args) < 1 || len(d.args) > 2 || d.args[0] == "" {
+					return nil, fmt.Errorf("NewTable failed because %s field %s of %s has no index name", d.name, field.Name, rowType)
+				}
+				position := 1
+				if len(d.args) == 2 {
+					var err error
+					if position, err = strconv.Atoi(d.args[1]); err != nil || position < 1 {
+						return nil, fmt.Errorf("NewTable failed because index field %s of %s has invalid position %s", field.Name, rowType, d.args[1])
+					}
+				}
+				name := d.args[0]
+				if indexFields[name] == nil {
+					indexFields[name] = make(map[int]string)
+					indexNames = append(indexNames, name)
+					unique[name] = d.name == "unique"
+				} else if unique[name] != (d.name == "unique") {
+					return nil, fmt.Errorf("NewTable failed because %s is both an index and a unique constraint of %s", name, rowType)
+				}
+				if _, ok := indexFields[name][position]; ok {
+					return nil, fmt.Errorf("NewTable failed because index %s of %s has two fields at position %d", name, rowType, position)
+				}
+				indexFields[name][position] = jsonFieldName(field)
+			default:
+				if _, err := schema.addTagRule(field, d); err != nil {
+					return nil, fmt.Errorf("NewTable failed because %v", err)
+				}
+			}
+		}
+	}
+
+	if table.Name == "" {
+		return nil, fmt.Errorf("NewTable failed because %s does not declare a table name", rowType)
+	}
+	if len(positions) == 0 {
+		return nil, fmt.Errorf("NewTable failed because %s does not declare any key field", rowType)
+	}
+	order := make([]int, 0, len(positions))
+	for position := range positions {
+		order = append(order, position)
+	}
+	sort.Ints(order)
+	for i, position := range order {
+		if position != i+1 {
+			return nil, fmt.Errorf("NewTable failed because the key positions of %s are not 1 to %d", rowType, len(order))
+		}
+		table.keyFields = append(table.keyFields, positions[position])
+		table.Keys = append(table.Keys, rowType.Field(positions[position]).Name)
+	}
+
+	definition := &TableDefinition{Name: table.Name, SoftDelete: softDelete, Audit: audit}
+	for _, name := range indexNames {
+		fields := make([]string, 0, len(indexFields[name]))
+		for position := 1; position <= len(indexFields[name]); position++ {
+			field, ok := indexFields[name][position]
+			if !ok {
+				return nil, fmt.Errorf("NewTable failed because the field positions of index %s of %s are not 1 to %d", name, rowType, len(indexFields[name]))
+			}
+			fields = append(fields, field)
+		}
+		definition.Indexes = append(definition.Indexes, &TableIndex{Table: table.Name, Name: name, Fields: fields, Unique: unique[name]})
+	}
+	if table.versionField >= 0 {
+		definition.VersionField = jsonFieldName(rowType.Field(table.versionField))
+	}
+	if len(schema.Required) > 0 || len(schema.Properties) > 0 {
+		definition.Schema = schema
+	}
+	if err := DeclareTable(definition); err != nil {
+		return nil, fmt.Errorf("NewTable failed because %v", err)
+	}
+	return table, nil
+}
+
+// jsonFieldName returns the name of a struct field in the JSON of the rows
+func jsonFieldName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		return name
+	}
+	return field.Name
+}
+
+// RowKeys returns the values of the key fields of row, in key order
+func (table *Table) RowKeys(row interface{}) ([]string, error) {
+	v, err := table.rowValue(row)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(table.keyFields))
+	for i, index := range table.keyFields {
+		key := fmt.Sprint(v.Field(index).Interface())
+		if key == "" {
+			return nil, fmt.Errorf("key field %s of table %s is empty", table.Keys[i], table.Name)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// rowValue returns the struct behind row, which must be a pointer to a row of the table
+func (table *Table) rowValue(row interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(row)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Type() != table.rowType {
+		return reflect.Value{}, fmt.Errorf("%T is not a pointer to a row of table %s (%s)", row, table.Name, table.rowType)
+	}
+	return v.Elem(), nil
+}
+
+// Insert stores a new row, it fails if a row with the same keys exists.
+// The version of a versioned row is set to 1.
+func (table *Table) Insert(stub shim.ChaincodeStubInterface, row interface{}) error {
+	keys, err := table.RowKeys(row)
+	if err != nil {
+		return fmt.Errorf("Insert failed because %v", err)
+	}
+	if _, err := InsertTableRow(stub, table.Name, keys, row, FAIL_BEFORE_OVERWRITE, nil); err != nil {
+		return fmt.Errorf("Insert failed because InsertTableRow failed with error %w", err)
+	}
+	table.setVersion(row, 1)
+	return nil
+}
+
+// Get reads the row whose key fields are set in row into row, it fails if the row does not exist
+func (table *Table) Get(stub shim.ChaincodeStubInterface, row interface{}) error {
+	keys, err := table.RowKeys(row)
+	if err != nil {
+		return fmt.Errorf("Get failed because %v", err)
+	}
+	if _, err := GetTableRow(stub, table.Name, keys, row, FAIL_IF_MISSING); err != nil {
+		return fmt.Errorf("Get failed because GetTableRow failed with error %v", err)
+	}
+	return nil
+}
+
+// Update replaces an existing row, it fails if the row does not exist.
+// A versioned row must be at the version of the stored row, which is then incremented in row.
+func (table *Table) Update(stub shim.ChaincodeStubInterface, row interface{}) error {
+	keys, err := table.RowKeys(row)
+	if err != nil {
+		return fmt.Errorf("Update failed because %v", err)
+	}
+	if _, err := InsertTableRow(stub, table.Name, keys, row, FAIL_UNLESS_OVERWRITE, nil); err != nil {
+		return fmt.Errorf("Update failed because InsertTableRow failed with error %w", err)
+	}
+	if table.versionField >= 0 {
+		v, _ := table.rowValue(row)
+		table.setVersion(row, versionOf(v.Field(table.versionField))+1)
+	}
+	return nil
+}
+
+// UpdateIfVersion replaces an existing row if the stored row is at version expected, whatever the version of row,
+// which is then set to the next version
+func (table *Table) UpdateIfVersion(stub shim.ChaincodeStubInterface, row interface{}, expected int64) error {
+	keys, err := table.RowKeys(row)
+	if err != nil {
+		return fmt.Errorf("UpdateIfVersion failed because %v", err)
+	}
+	if err := UpdateTableRowIfVersion(stub, table.Name, keys, row, expected); err != nil {
+		return fmt.Errorf("UpdateIfVersion failed because UpdateTableRowIfVersion failed with error %w", err)
+	}
+	table.setVersion(row, expected+1)
+	return nil
+}
+
+// setVersion sets the version field of a row checked with rowValue, if the rows are versioned
+func (table *Table) setVersion(row interface{}, version int64) {
+	if table.versionField < 0 {
+		return
+	}
+	field := reflect.ValueOf(row).Elem().Field(table.versionField)
+	switch field.Kind() {
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		field.SetUint(uint64(version))
+	default:
+		field.SetInt(version)
+	}
+}
+
+func versionOf(field reflect.Value) int64 {
+	switch field.Kind() {
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return int64(field.Uint())
+	default:
+		return field.Int()
+	}
+}
+
+// Delete removes the row whose key fields are set in row, it fails if the row does not exist
+func (table *Table) Delete(stub shim.ChaincodeStubInterface, row interface{}) error {
+	keys, err := table.RowKeys(row)
+	if err != nil {
+		return fmt.Errorf("Delete failed because %v", err)
+	}
+	if _, err := DeleteTableRow(stub, table.Name, keys, nil, FAIL_IF_MISSING); err != nil {
+		return fmt.Errorf("Delete failed because DeleteTableRow failed with error %v", err)
+	}
+	return nil
+}
+
+// Restore brings back the soft deleted row whose key fields are set in row
+func (table *Table) Restore(stub shim.ChaincodeStubInterface, row interface{}) error {
+	keys, err := table.RowKeys(row)
+	if err != nil {
+		return fmt.Errorf("Restore failed because %v", err)
+	}
+	if err := RestoreTableRow(stub, table.Name, keys); err != nil {
+		return fmt.Errorf("Restore failed because %w", err)
+	}
+	return nil
+}
+
+// Purge deletes for good the soft deleted row whose key fields are set in row
+func (table *Table) Purge(stub shim.ChaincodeStubInterface, row interface{}) error {
+	keys, err := table.RowKeys(row)
+	if err != nil {
+		return fmt.Errorf("Purge failed because %v", err)
+	}
+	if err := PurgeTableRow(stub, table.Name, keys); err != nil {
+		return fmt.Errorf("Purge failed because %v", err)
+	}
+	return nil
+}
+
+// List reads into rows, a pointer to a slice of rows or of pointers to rows, the rows whose first keys are partialKeys.
+// Without partialKeys every row of the table is listed.
+func (table *Table) List(stub shim.ChaincodeStubInterface, rows interface{}, partialKeys ...string) error {
+	if err := table.checkRowSlice(rows); err != nil {
+		return fmt.Errorf("List failed because %v", err)
+	}
+	if len(partialKeys) > len(table.Keys) {
+		return fmt.Errorf("List failed because table %s has %d keys, %d were given", table.Name, len(table.Keys), len(partialKeys))
+	}
+
+	rowsJSON := make([][]byte, 0)
+	err := ForEachTableRow(stub, table.Name, partialKeys, func(row []byte) error {
+		rowsJSON = append(rowsJSON, row)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("List failed because %v", err)
+	}
+	if err := table.setRows(rows, rowsJSON); err != nil {
+		return fmt.Errorf("List failed because %v", err)
+	}
+	return nil
+}
+
+// ListByIndex reads into rows, a pointer to a slice of rows or of pointers to rows,
+// the rows whose first fields of the secondary index are values
+func (table *Table) ListByIndex(stub shim.ChaincodeStubInterface, rows interface{}, index string, values ...interface{}) error {
+	if err := table.checkRowSlice(rows); err != nil {
+		return fmt.Errorf("ListByIndex failed because %v", err)
+	}
+	rowsJSON, err := GetTableRowsByIndex(stub, table.Name, index, values...)
+	if err != nil {
+		return fmt.Errorf("ListByIndex failed because %v", err)
+	}
+	if err := table.setRows(rows, rowsJSON); err != nil {
+		return fmt.Errorf("ListByIndex failed because %v", err)
+	}
+	return nil
+}
+
+// checkRowSlice checks that rows is a pointer to a slice of rows or of pointers to rows of the table
+func (table *Table) checkRowSlice(rows interface{}) error {
+	slice := reflect.ValueOf(rows)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("%T is not a pointer to a slice", rows)
+	}
+	elemType := slice.Elem().Type().Elem()
+	if elemType != table.rowType && (elemType.Kind() != reflect.Ptr || elemType.Elem() != table.rowType) {
+		return fmt.Errorf("%T is not a slice of rows of table %s (%s)", rows, table.Name, table.rowType)
+	}
+	return nil
+}
+
+// setRows unmarshals rowsJSON into rows, checked with checkRowSlice
+func (table *Table) setRows(rows interface{}, rowsJSON [][]byte) error {
+	slice := reflect.ValueOf(rows).Elem()
+	isPtr := slice.Type().Elem().Kind() == reflect.Ptr
+	result := reflect.MakeSlice(slice.Type(), 0, len(rowsJSON))
+	for _, bytes := range rowsJSON {
+		row := reflect.New(table.rowType)
+		if err := json.Unmarshal(bytes, row.Interface()); err != nil {
+			return fmt.Errorf("json.Unmarshal failed with error %v", err)
+		}
+		if isPtr {
+			result = reflect.Append(result, row)
+		} else {
+			result = reflect.Append(result, row.Elem())
+		}
+	}
+	slice.Set(result)
+	return nil
+}
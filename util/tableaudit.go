@@ -0,0 +1,142 @@
+package util
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// auditField is the reserved field of the audit metadata of rows
+const auditField = "~audit"
+
+// AuditIdentity is the creator of a transaction
+type AuditIdentity struct {
+	MspID   string `json:"mspID"`
+	Subject string `json:"subject"` // subject of the certificate, e.g. CN=alice,O=Org1MSP
+}
+
+// RowAudit is the audit metadata of a row, which InsertTableRow and UpdateTableRow write for tables declared with DeclareAudit.
+// Rows read into a struct get it with a field of type *RowAudit tagged `json:"~audit,omitempty"`, the values
+// written in that field are always replaced.
+type RowAudit struct {
+	CreatedBy AuditIdentity `json:"createdBy"`
+	CreatedAt string        `json:"createdAt"` // transaction timestamp, RFC 3339
+	UpdatedBy AuditIdentity `json:"updatedBy"`
+	UpdatedAt string        `json:"updatedAt"`
+	TxID      string        `json:"txID"` // last transaction that wrote the row
+}
+
+// DeclareAudit makes the table functions stamp the rows of table with their audit metadata:
+// who created and last updated them, when, and in which transaction
+func DeclareAudit(table string) error {
+	if table == "" {
+		return fmt.Errorf("DeclareAudit failed because the table is required")
+	}
+	return updateTableDefinition(table, func(definition *TableDefinition) error {
+		definition.Audit = true
+		return nil
+	})
+}
+
+// isAudited tells whether the rows of table carry audit metadata
+func isAudited(table string) bool {
+	return getTableDefinition(table).Audit
+}
+
+// GetRowAudit returns the audit metadata of a JSON row, nil if it has none
+func GetRowAudit(row []byte) (*RowAudit, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(row, &fields); err != nil {
+		return nil, fmt.Errorf("GetRowAudit failed because the row is not a JSON object: %v", err)
+	}
+	raw, ok := fields[auditField]
+	if !ok || string(raw) == "null" {
+		return nil, nil
+	}
+	audit := new(RowAudit)
+	if err := json.Unmarshal(raw, audit); err != nil {
+		return nil, fmt.Errorf("GetRowAudit failed because json.Unmarshal failed with error %v", err)
+	}
+	return audit, nil
+}
+
+// stampRowAudit returns the row written over oldRow, nil meaning no row, with the audit metadata of the running
+// transaction. The creation metadata of oldRow is kept. Rows of tables without audit are returned as they are.
+func stampRowAudit(stub shim.ChaincodeStubInterface, table string, oldRow []byte, newRow []byte) ([]byte, error) {
+	if !isAudited(table) {
+		return newRow, nil
+	}
+	creator, err := creatorIdentity(stub)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	audit := &RowAudit{CreatedBy: creator, CreatedAt: timestamp}
+	if oldRow != nil {
+		previous, err := GetRowAudit(oldRow)
+		if err != nil {
+			return nil, fmt.Errorf("the stored row has invalid audit metadata: %v", err)
+		}
+		if previous != nil {
+			audit.CreatedBy, audit.CreatedAt = previous.CreatedBy, previous.CreatedAt
+		}
+	}
+	audit.UpdatedBy, audit.UpdatedAt, audit.TxID = creator, timestamp, stub.GetTxID()
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(newRow, &fields); err != nil {
+		return nil, fmt.Errorf("the row is not a JSON object: %v", err)
+	}
+	if fields[auditField], err = json.Marshal(audit); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// creatorIdentity returns the MSP ID and the certificate subject of the creator of the running transaction
+func creatorIdentity(stub shim.ChaincodeStubInterface) (AuditIdentity, error) {
+	creator, err := stub.GetCreator()
+	if err != nil {
+		return AuditIdentity{}, fmt.Errorf("stub.GetCreator failed with error %v", err)
+	}
+	if len(creator) == 0 {
+		return AuditIdentity{}, fmt.Errorf("the transaction has no creator")
+	}
+	sid := new(msp.SerializedIdentity)
+	if err := proto.Unmarshal(creator, sid); err != nil {
+		return AuditIdentity{}, fmt.Errorf("the creator is not a serialized identity: %v", err)
+	}
+	block, _ := pem.Decode(sid.IdBytes)
+	if block == nil {
+		return AuditIdentity{}, fmt.Errorf("the creator of %s has no PEM certificate", sid.Mspid)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return AuditIdentity{}, fmt.Errorf("x509.ParseCertificate failed with error %v", err)
+	}
+	return AuditIdentity{MspID: sid.Mspid, Subject: cert.Subject.String()}, nil
+}
+
+// txTimestamp returns the timestamp of the running transaction in RFC 3339 format
+func txTimestamp(stub shim.ChaincodeStubInterface) (string, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("stub.GetTxTimestamp failed with error %v", err)
+	}
+	t, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return "", fmt.Errorf("the transaction timestamp is invalid: %v", err)
+	}
+	return t.UTC().Format(time.RFC3339Nano), nil
+}
@@ -0,0 +1,282 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// TableRow is a row of a batch of InsertTableRows or UpdateTableRows
+type TableRow struct {
+	Keys  []string
+	Value interface{} // must be json.Marshal-able
+}
+
+// batchWrite is the checked write of a row of a batch
+type batchWrite struct {
+	rowKeys      []string
+	compositeKey string
+	oldRow       []byte // visible row before the write, nil if there is none
+	newRow       []byte // row after the write, nil if it is deleted
+	deleted      bool   // the row is deleted, newRow is its tombstone if the table has soft deletes
+}
+
+// tableBatch checks every row of a batch before any of them is written
+type tableBatch struct {
+	table  string
+	writes []*batchWrite
+	rows   map[string]int      // composite key -> position of the row in the batch
+	unique map[string][]string // unique constraint entry -> keys of the row of the batch that takes it
+	errors []*RowError
+}
+
+func newTableBatch(table string) *tableBatch {
+	return &tableBatch{
+		table:  table,
+		rows:   make(map[string]int),
+		unique: make(map[string][]string),
+		errors: make([]*RowError, 0),
+	}
+}
+
+// InsertTableRows inserts rows into table, checking each row as InsertTableRow does with failure_option.
+// Every row is checked before anything is written: if one row fails, nothing is written and the returned
+// BatchError lists the error of every failing row. Rows of the same batch cannot have the same keys or the
+// same unique values, but a row can take the unique values that another row of the batch gives up.
+func InsertTableRows(
+	stub shim.ChaincodeStubInterface,
+	table_name string,
+	rows []TableRow,
+	failure_option InsertTableRow_FailureOption,
+) error {
+	batch := newTableBatch(table_name)
+	for i, row := range rows {
+		w, err := prepareRowWrite(stub, table_name, row, failure_option)
+		batch.add(stub, i, row.Keys, w, err)
+	}
+	batch.checkUniqueConstraints(stub)
+	if err := batch.write(stub); err != nil {
+		return fmt.Errorf("InsertTableRows failed because %w", err)
+	}
+	return nil
+}
+
+// UpdateTableRows replaces existing rows of table, like InsertTableRows with FAIL_UNLESS_OVERWRITE:
+// nothing is written if one of the rows does not exist or fails its checks
+func UpdateTableRows(
+	stub shim.ChaincodeStubInterface,
+	table_name string,
+	rows []TableRow,
+) error {
+	batch := newTableBatch(table_name)
+	for i, row := range rows {
+		w, err := prepareRowWrite(stub, table_name, row, FAIL_UNLESS_OVERWRITE)
+		batch.add(stub, i, row.Keys, w, err)
+	}
+	batch.checkUniqueConstraints(stub)
+	if err := batch.write(stub); err != nil {
+		return fmt.Errorf("UpdateTableRows failed because %w", err)
+	}
+	return nil
+}
+
+// DeleteTableRows deletes the rows of table with the given keys, or marks them deleted if the table has soft deletes.
+// With FAIL_IF_MISSING, nothing is deleted if one of the rows does not exist.
+func DeleteTableRows(
+	stub shim.ChaincodeStubInterface,
+	table_name string,
+	row_keys [][]string,
+	failure_option GetTableRow_FailureOption,
+) error {
+	batch := newTableBatch(table_name)
+	for i, keys := range row_keys {
+		w, err := prepareRowDelete(stub, table_name, keys, failure_option)
+		batch.add(stub, i, keys, w, err)
+	}
+	if err := batch.write(stub); err != nil {
+		return fmt.Errorf("DeleteTableRows failed because %w", err)
+	}
+	return nil
+}
+
+// prepareRowWrite checks a row of a batch the way InsertTableRow does, without writing it.
+// Its unique values are checked against the state by tableBatch.checkUniqueConstraints once the batch is complete.
+func prepareRowWrite(
+	stub shim.ChaincodeStubInterface,
+	table_name string,
+	row TableRow,
+	failure_option InsertTableRow_FailureOption,
+) (*batchWrite, error) {
+	if InterfaceIsNilOrIsZeroOfUnderlyingType(row.Value) {
+		return nil, fmt.Errorf("the row value is nil")
+	}
+	w, err := readBatchRow(stub, table_name, row.Keys)
+	if err != nil {
+		return nil, err
+	}
+	if failure_option == FAIL_BEFORE_OVERWRITE && w.oldRow != nil {
+		return nil, fmt.Errorf("the row existed already and FAIL_BEFORE_OVERWRITE was specified")
+	} else if failure_option == FAIL_UNLESS_OVERWRITE && w.oldRow == nil {
+		return nil, fmt.Errorf("the row did not yet exist and FAIL_UNLESS_OVERWRITE was specified")
+	}
+
+	value, err := json.Marshal(row.Value)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed with error %v", err)
+	}
+	if w.newRow, err = stampTableRow(stub, table_name, row.Keys, w.oldRow, value, nil); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// prepareRowDelete checks the deletion of a row of a batch the way DeleteTableRow does, without deleting it
+func prepareRowDelete(
+	stub shim.ChaincodeStubInterface,
+	table_name string,
+	row_keys []string,
+	failure_option GetTableRow_FailureOption,
+) (*batchWrite, error) {
+	w, err := readBatchRow(stub, table_name, row_keys)
+	if err != nil {
+		return nil, err
+	}
+	if w.oldRow == nil {
+		if failure_option == FAIL_IF_MISSING {
+			return nil, fmt.Errorf("the row was not found and FAIL_IF_MISSING was specified")
+		}
+		return w, nil
+	}
+
+	w.deleted = true
+	if isSoftDelete(table_name) {
+		if w.newRow, err = tombstoneRow(stub, w.oldRow); err != nil {
+			return nil, fmt.Errorf("tombstoneRow failed with error %v", err)
+		}
+	}
+	return w, nil
+}
+
+// readBatchRow reads the visible value of a row of a batch, soft deleted rows are read as missing
+func readBatchRow(stub shim.ChaincodeStubInterface, table_name string, row_keys []string) (*batchWrite, error) {
+	compositeKey, err := stub.CreateCompositeKey(table_name, row_keys)
+	if err != nil {
+		return nil, fmt.Errorf("stub.CreateCompositeKey failed with error %v", err)
+	}
+	row, err := getTableState(stub, compositeKey)
+	if err != nil {
+		return nil, fmt.Errorf("stub.GetState(%v) failed with error %v", compositeKey, err)
+	}
+	if isDeletedRow(table_name, row) {
+		row = nil
+	}
+	return &batchWrite{rowKeys: row_keys, compositeKey: compositeKey, oldRow: row}, nil
+}
+
+// add adds the checked write of the row at position index of the batch, or records why it failed
+func (batch *tableBatch) add(stub shim.ChaincodeStubInterface, index int, rowKeys []string, w *batchWrite, err error) {
+	if err == nil {
+		err = batch.claim(stub, index, w)
+	}
+	if err != nil {
+		batch.errors = append(batch.errors, &RowError{Index: index, RowKeys: rowKeys, Err: err})
+		return
+	}
+	batch.writes = append(batch.writes, w)
+}
+
+// claim checks that no other row of the batch has the same keys or takes the same unique values as w
+func (batch *tableBatch) claim(stub shim.ChaincodeStubInterface, index int, w *batchWrite) error {
+	if other, ok := batch.rows[w.compositeKey]; ok {
+		return fmt.Errorf("row %d of the batch has the same keys", other)
+	}
+	batch.rows[w.compositeKey] = index
+	if w.deleted {
+		return nil
+	}
+
+	for _, tableIndex := range getTableIndexes(batch.table) {
+		if !tableIndex.Unique {
+			continue
+		}
+		attributes, indexed, err := tableIndex.attributes(w.newRow)
+		if err != nil || !indexed {
+			continue
+		}
+		entry, err := tableIndex.entryKey(stub, attributes, w.rowKeys)
+		if err != nil {
+			return err
+		}
+		if owner, ok := batch.unique[entry]; ok {
+			return &UniqueViolationError{Table: batch.table, Constraint: tableIndex.Name, Values: attributeValues(attributes), RowKeys: owner}
+		}
+		batch.unique[entry] = w.rowKeys
+	}
+	return nil
+}
+
+// checkUniqueConstraints checks the unique values of the rows of the batch against the state. The values
+// held by rows of the batch that give them up can be taken, claim has already checked that only one row takes them.
+func (batch *tableBatch) checkUniqueConstraints(stub shim.ChaincodeStubInterface) {
+	released := make(map[string]bool)
+	for _, w := range batch.writes {
+		changes := new(indexChanges)
+		if err := changes.add(stub, batch.table, w.rowKeys, w.oldRow, w.indexedRow()); err != nil {
+			continue // reported by write
+		}
+		for _, key := range changes.removed {
+			released[key] = true
+		}
+	}
+	for _, w := range batch.writes {
+		if w.deleted {
+			continue
+		}
+		if err := checkUniqueConstraints(stub, batch.table, w.rowKeys, w.oldRow, w.newRow, released); err != nil {
+			batch.errors = append(batch.errors, &RowError{Index: batch.rows[w.compositeKey], RowKeys: w.rowKeys,
+				Err: fmt.Errorf("checkUniqueConstraints failed with error %w", err)})
+		}
+	}
+	sort.SliceStable(batch.errors, func(i, j int) bool { return batch.errors[i].Index < batch.errors[j].Index })
+}
+
+// indexedRow is the row after the write as its index entries see it, nil if it is deleted
+func (w *batchWrite) indexedRow() []byte {
+	if w.deleted {
+		return nil
+	}
+	return w.newRow
+}
+
+// write writes every row of the batch if none of them failed, and returns a BatchError otherwise.
+// An error while writing leaves the batch half written, the transaction must then fail.
+func (batch *tableBatch) write(stub shim.ChaincodeStubInterface) error {
+	if len(batch.errors) > 0 {
+		return &BatchError{Table: batch.table, Rows: batch.errors}
+	}
+	changes := new(indexChanges)
+	for _, w := range batch.writes {
+		switch {
+		case w.newRow != nil:
+			if err := putTableState(stub, w.compositeKey, w.newRow); err != nil {
+				return fmt.Errorf("stub.PutState(%v) failed with error %v", w.compositeKey, err)
+			}
+		case w.oldRow != nil:
+			if err := delTableState(stub, w.compositeKey); err != nil {
+				return fmt.Errorf("stub.DelState(%v) failed with error %v", w.compositeKey, err)
+			}
+		default:
+			continue
+		}
+
+		if err := changes.add(stub, batch.table, w.rowKeys, w.oldRow, w.indexedRow()); err != nil {
+			return fmt.Errorf("updateTableIndexes failed with error %v", err)
+		}
+	}
+	if err := changes.write(stub); err != nil {
+		return fmt.Errorf("updateTableIndexes failed with error %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// TableDefinition is everything declared about a table: its indexes, the validation rules and the version,
+// soft delete and audit behaviour of its rows. The table functions look it up by table name.
+//
+// Declarations are kept for the life of the process and shared by every stub, so a chaincode should declare
+// its tables before it writes any row, e.g. with NewTable in a package variable or at the start of Init.
+// Declaring the same rule twice is allowed as long as it does not change, except for the schema which is
+// replaced. Rows written before an index is declared are not indexed until IndexTableRows is called.
+type TableDefinition struct {
+	Name         string
+	Indexes      []*TableIndex
+	Schema       *TableSchema
+	VersionField string // JSON field holding the version of the rows, empty if they are not versioned
+	SoftDelete   bool
+	Audit        bool
+}
+
+// tableDefinitions are the declared tables, by table name. A definition is never changed once stored,
+// a declaration stores a new copy so that the table functions can use a definition without locking.
+var (
+	tableDefinitions      = make(map[string]*TableDefinition)
+	tableDefinitionsMutex sync.RWMutex
+)
+
+// DeclareTable adds the indexes, schema, version field, soft delete and audit of definition to the
+// declaration of its table. Nothing is declared if one of them conflicts with a previous declaration.
+func DeclareTable(definition *TableDefinition) error {
+	if definition == nil || definition.Name == "" {
+		return fmt.Errorf("DeclareTable failed because the table name is required")
+	}
+	if definition.Schema != nil {
+		if err := definition.Schema.compile(); err != nil {
+			return fmt.Errorf("DeclareTable failed because %v", err)
+		}
+	}
+	err := updateTableDefinition(definition.Name, func(declared *TableDefinition) error {
+		for _, index := range definition.Indexes {
+			if err := declared.addIndex(index); err != nil {
+				return err
+			}
+		}
+		if definition.VersionField != "" {
+			if err := declared.setVersionField(definition.VersionField); err != nil {
+				return err
+			}
+		}
+		if definition.Schema != nil {
+			declared.Schema = definition.Schema
+		}
+		declared.SoftDelete = declared.SoftDelete || definition.SoftDelete
+		declared.Audit = declared.Audit || definition.Audit
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("DeclareTable failed because %v", err)
+	}
+	return nil
+}
+
+// ResetTableDefinitions forgets every declared table. It is meant for tests that declare tables
+// of the same name differently, e.g. with defer util.ResetTableDefinitions().
+func ResetTableDefinitions() {
+	tableDefinitionsMutex.Lock()
+	defer tableDefinitionsMutex.Unlock()
+	tableDefinitions = make(map[string]*TableDefinition)
+}
+
+// getTableDefinition returns the definition of table, an empty one if nothing is declared about it
+func getTableDefinition(table string) *TableDefinition {
+	tableDefinitionsMutex.RLock()
+	defer tableDefinitionsMutex.RUnlock()
+	if definition, ok := tableDefinitions[table]; ok {
+		return definition
+	}
+	return &TableDefinition{Name: table}
+}
+
+// updateTableDefinition applies change to a copy of the definition of table and stores the copy if change succeeds
+func updateTableDefinition(table string, change func(definition *TableDefinition) error) error {
+	tableDefinitionsMutex.Lock()
+	defer tableDefinitionsMutex.Unlock()
+	definition := &TableDefinition{Name: table}
+	if declared, ok := tableDefinitions[table]; ok {
+		*definition = *declared
+		definition.Indexes = append([]*TableIndex(nil), declared.Indexes...)
+	}
+	if err := change(definition); err != nil {
+		return err
+	}
+	tableDefinitions[table] = definition
+	return nil
+}
+
+// addIndex adds an index to the definition, or does nothing if the same index is already declared
+func (definition *TableDefinition) addIndex(declared *TableIndex) error {
+	if declared == nil || declared.Name == "" || len(declared.Fields) == 0 {
+		return fmt.Errorf("the table, the index name and the fields are required")
+	}
+	if declared.Table != definition.Name {
+		return fmt.Errorf("index %s is declared on table %s instead of %s", declared.Name, declared.Table, definition.Name)
+	}
+	for _, index := range definition.Indexes {
+		if index.Name != declared.Name {
+			continue
+		}
+		if fmt.Sprint(index.Fields) != fmt.Sprint(declared.Fields) || index.Unique != declared.Unique {
+			return fmt.Errorf("index %s of table %s is already declared on fields %v (unique: %v)",
+				index.Name, index.Table, index.Fields, index.Unique)
+		}
+		return nil
+	}
+	definition.Indexes = append(definition.Indexes, declared)
+	return nil
+}
+
+// setVersionField sets the version field of the definition, which cannot change once declared
+func (definition *TableDefinition) setVersionField(field string) error {
+	if definition.VersionField != "" && definition.VersionField != field {
+		return fmt.Errorf("table %s already has version field %s", definition.Name, definition.VersionField)
+	}
+	definition.VersionField = field
+	return nil
+}
+
+// IndexTableRows writes the index entries of the rows of table that are missing from its indexes,
+// which is the case of the rows written before the indexes were declared. It fails with a
+// UniqueViolationError if two rows have the same values for a unique constraint.
+func IndexTableRows(stub shim.ChaincodeStubInterface, table string) error {
+	indexes := getTableDefinition(table).Indexes
+	if len(indexes) == 0 {
+		return nil
+	}
+	iterator, err := stub.GetStateByPartialCompositeKey(table, []string{})
+	if err != nil {
+		return fmt.Errorf("IndexTableRows failed because GetStateByPartialCompositeKey failed with error %v", err)
+	}
+	defer iterator.Close()
+
+	owners := make(map[string][]string) // unique entries written here, the state may not return them
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return fmt.Errorf("IndexTableRows failed because the iterator failed with error %v", err)
+		}
+		if isDeletedRow(table, kv.Value) {
+			continue
+		}
+		_, rowKeys, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return fmt.Errorf("IndexTableRows failed because SplitCompositeKey failed with error %v", err)
+		}
+		for _, index := range indexes {
+			if !index.Unique {
+				continue
+			}
+			attributes, indexed, err := index.attributes(kv.Value)
+			if err != nil || !indexed {
+				continue
+			}
+			entry, err := index.entryKey(stub, attributes, rowKeys)
+			if err != nil {
+				return fmt.Errorf("IndexTableRows failed because %v", err)
+			}
+			if owner, ok := owners[entry]; ok {
+				return fmt.Errorf("IndexTableRows failed because %w",
+					&UniqueViolationError{Table: table, Constraint: index.Name, Values: attributeValues(attributes), RowKeys: owner})
+			}
+			owners[entry] = rowKeys
+		}
+		if err := checkUniqueConstraints(stub, table, rowKeys, nil, kv.Value, nil); err != nil {
+			return fmt.Errorf("IndexTableRows failed because %w", err)
+		}
+		if err := updateTableIndexes(stub, table, rowKeys, nil, kv.Value); err != nil {
+			return fmt.Errorf("IndexTableRows failed because %v", err)
+		}
+	}
+	return nil
+}
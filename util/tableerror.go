@@ -0,0 +1,126 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Akachain/akc-go-sdk/common"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// CodedError is an error of the table functions that maps to a response code of common.ResCodeDict
+type CodedError interface {
+	error
+	Code() string
+}
+
+// ErrorCode returns the response code of the first CodedError wrapped in err, or defaultCode if there is none
+func ErrorCode(err error, defaultCode string) string {
+	var coded CodedError
+	if errors.As(err, &coded) {
+		return coded.Code()
+	}
+	return defaultCode
+}
+
+// RespondTableError builds the error response of err with its response code, or defaultCode if it has none
+func RespondTableError(err error, defaultCode string) pb.Response {
+	code := ErrorCode(err, defaultCode)
+	resErr := common.ResponseError{ResCode: code, Msg: fmt.Sprintf("%s %s", common.ResCodeDict[code], err.Error())}
+	return common.RespondError(resErr)
+}
+
+// UniqueViolationError is returned when a row would take values of a unique constraint that belong to another row
+type UniqueViolationError struct {
+	Table      string
+	Constraint string
+	Values     []string // values of the constraint fields
+	RowKeys    []string // keys of the row the values belong to
+}
+
+func (e *UniqueViolationError) Error() string {
+	return fmt.Sprintf("unique constraint %s of table %s is violated: values [%s] already belong to row %v",
+		e.Constraint, e.Table, strings.Join(e.Values, ", "), e.RowKeys)
+}
+
+// Code returns the response code of unique violations
+func (e *UniqueViolationError) Code() string {
+	return common.ERR19
+}
+
+// SchemaViolationError is returned when a row breaks rules of the schema of its table
+type SchemaViolationError struct {
+	Table      string
+	Violations []FieldViolation
+}
+
+func (e *SchemaViolationError) Error() string {
+	fields := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		if v.Field == "" {
+			fields = append(fields, v.Message)
+		} else {
+			fields = append(fields, fmt.Sprintf("%s %s", v.Field, v.Message))
+		}
+	}
+	return fmt.Sprintf("row of table %s is invalid: %s", e.Table, strings.Join(fields, "; "))
+}
+
+// Code returns the response code of invalid rows
+func (e *SchemaViolationError) Code() string {
+	return common.ERR20
+}
+
+// VersionConflictError is returned when a row is written with another version than the stored one,
+// which means that the row changed since the caller read it
+type VersionConflictError struct {
+	Table    string
+	RowKeys  []string
+	Expected int64 // version given by the caller
+	Actual   int64 // version of the stored row, 0 if there is none
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("row %v of table %s is at version %d, version %d was expected", e.RowKeys, e.Table, e.Actual, e.Expected)
+}
+
+// Code returns the response code of version conflicts
+func (e *VersionConflictError) Code() string {
+	return common.ERR21
+}
+
+// RowError is the error of a row of a batch, Index is its position in the batch
+type RowError struct {
+	Index   int
+	RowKeys []string
+	Err     error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("row %d %v: %v", e.Index, e.RowKeys, e.Err)
+}
+
+// Unwrap returns the error of the row, so that ErrorCode finds its response code
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned when rows of a batch fail their checks, in which case no row of the batch is written
+type BatchError struct {
+	Table string
+	Rows  []*RowError
+}
+
+func (e *BatchError) Error() string {
+	rows := make([]string, 0, len(e.Rows))
+	for _, row := range e.Rows {
+		rows = append(rows, row.Error())
+	}
+	return fmt.Sprintf("%d rows of the batch on table %s failed: %s", len(e.Rows), e.Table, strings.Join(rows, "; "))
+}
+
+// Code returns the response code of failed batches, the code of each row is given by ErrorCode(row, ...)
+func (e *BatchError) Code() string {
+	return common.ERR22
+}
@@ -0,0 +1,361 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// TableIndex is a secondary index of a table. For each row, InsertTableRow, UpdateTableRow and DeleteTableRow
+// maintain an index entry in the same transaction: a composite key of object type <table>~<index> made of
+// the values of the index fields followed by the row keys. The values keep their JSON type: a string is
+// the string after a '"', any other value is its JSON, so that the string "1" and the number 1 differ.
+// The entries of a unique index are reserved keys made of the values of the index fields only,
+// whose value is the JSON of the row keys: a row cannot take the values reserved by another row.
+type TableIndex struct {
+	Table  string
+	Name   string
+	Fields []string // JSON field names of the rows, in order
+	Unique bool
+}
+
+// indexEntryValue is the value of the index entries, as an empty value would delete them
+var indexEntryValue = []byte{0x00}
+
+// stringAttributePrefix starts the index attributes of strings, JSON values of other types never start with it
+const stringAttributePrefix = `"`
+
+// DeclareIndex declares a secondary index of table on fields, the JSON field names of its rows,
+// e.g. DeclareIndex("Data_", "Attribute1", "Attribute1"), see TableDefinition.
+func DeclareIndex(table string, name string, fields ...string) error {
+	if err := declareIndex(&TableIndex{Table: table, Name: name, Fields: fields}); err != nil {
+		return fmt.Errorf("DeclareIndex failed because %v", err)
+	}
+	return nil
+}
+
+// DeclareUniqueConstraint declares that no two rows of table can have the same values for fields,
+// e.g. DeclareUniqueConstraint("User_", "byEmail", "email"). InsertTableRow and UpdateTableRow fail
+// with a UniqueViolationError when a row would take the values of another row.
+// The constraint is a unique index, its rows can be looked up with GetRowKeysByIndex.
+func DeclareUniqueConstraint(table string, name string, fields ...string) error {
+	if err := declareIndex(&TableIndex{Table: table, Name: name, Fields: fields, Unique: true}); err != nil {
+		return fmt.Errorf("DeclareUniqueConstraint failed because %v", err)
+	}
+	return nil
+}
+
+func declareIndex(declared *TableIndex) error {
+	if declared.Table == "" {
+		return fmt.Errorf("the table, the index name and the fields are required")
+	}
+	return updateTableDefinition(declared.Table, func(definition *TableDefinition) error {
+		return definition.addIndex(declared)
+	})
+}
+
+// getTableIndexes returns the indexes declared on table
+func getTableIndexes(table string) []*TableIndex {
+	return getTableDefinition(table).Indexes
+}
+
+// getTableIndex returns an index of table by name
+func getTableIndex(table string, name string) (*TableIndex, error) {
+	for _, index := range getTableIndexes(table) {
+		if index.Name == name {
+			return index, nil
+		}
+	}
+	return nil, fmt.Errorf("table %s has no index %s", table, name)
+}
+
+// objectType is the object type of the composite keys of the index entries
+func (index *TableIndex) objectType() string {
+	return index.Table + "~" + index.Name
+}
+
+// attributes returns the values of the index fields of a JSON row, ok is false if the row
+// is nil or one of the fields is missing or null, in which case the row is not indexed
+func (index *TableIndex) attributes(row []byte) (attributes []string, ok bool, err error) {
+	if row == nil {
+		return nil, false, nil
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(row, &fields); err != nil {
+		return nil, false, fmt.Errorf("the row is not a JSON object: %v", err)
+	}
+	for _, name := range index.Fields {
+		raw, found := fields[name]
+		if !found || string(raw) == "null" {
+			return nil, false, nil
+		}
+		attribute, err := indexAttribute(raw)
+		if err != nil {
+			return nil, false, fmt.Errorf("field %s of the row is invalid: %v", name, err)
+		}
+		attributes = append(attributes, attribute)
+	}
+	return attributes, true, nil
+}
+
+// indexAttribute returns the index attribute of a JSON value
+func indexAttribute(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return stringAttributePrefix + s, nil
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return "", err
+	}
+	return compact.String(), nil
+}
+
+// indexAttributes returns the index attributes of the values looked up in an index
+func indexAttributes(values []interface{}) ([]string, error) {
+	attributes := make([]string, 0, len(values))
+	for _, value := range values {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("value %v cannot be marshalled: %v", value, err)
+		}
+		attribute, err := indexAttribute(raw)
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, attribute)
+	}
+	return attributes, nil
+}
+
+// attributeValues returns the values of index attributes as they are shown in errors
+func attributeValues(attributes []string) []string {
+	values := make([]string, 0, len(attributes))
+	for _, attribute := range attributes {
+		values = append(values, strings.TrimPrefix(attribute, stringAttributePrefix))
+	}
+	return values
+}
+
+// getPreviousRow returns the current value of a row if its table has indexes, versions, soft deletes or audit,
+// so that its index entries can be updated, its version checked, its tombstone written and its creation kept.
+// Soft deleted rows are returned as nil, their index entries are already removed.
+func getPreviousRow(stub shim.ChaincodeStubInterface, table string, compositeKey string) ([]byte, error) {
+	_, versioned := getVersionField(table)
+	if len(getTableIndexes(table)) == 0 && !versioned && !isSoftDelete(table) && !isAudited(table) {
+		return nil, nil
+	}
+	row, err := getTableState(stub, compositeKey)
+	if err != nil || isDeletedRow(table, row) {
+		return nil, err
+	}
+	return row, nil
+}
+
+// entryKey returns the key of the index entry of a row
+func (index *TableIndex) entryKey(stub shim.ChaincodeStubInterface, attributes []string, rowKeys []string) (string, error) {
+	if index.Unique {
+		return stub.CreateCompositeKey(index.objectType(), attributes)
+	}
+	return stub.CreateCompositeKey(index.objectType(), append(attributes, rowKeys...))
+}
+
+// entryValue returns the value of the index entry of a row
+func (index *TableIndex) entryValue(rowKeys []string) ([]byte, error) {
+	if index.Unique {
+		return json.Marshal(rowKeys)
+	}
+	return indexEntryValue, nil
+}
+
+// checkUniqueConstraints returns a UniqueViolationError if a row whose value changes from oldRow to newRow
+// takes the values of a unique constraint that belong to another row. It is called before the row is written
+// so that a violation leaves the state untouched. The entries in released are given up by their rows in the
+// same write, e.g. by another row of a batch, and can be taken.
+func checkUniqueConstraints(stub shim.ChaincodeStubInterface, table string, rowKeys []string, oldRow []byte, newRow []byte,
+	released map[string]bool) error {
+	for _, index := range getTableIndexes(table) {
+		if !index.Unique {
+			continue
+		}
+		oldAttributes, oldIndexed, err := index.attributes(oldRow)
+		if err != nil {
+			return fmt.Errorf("unique constraint %s of the previous row failed: %v", index.Name, err)
+		}
+		newAttributes, newIndexed, err := index.attributes(newRow)
+		if err != nil {
+			return fmt.Errorf("unique constraint %s of the new row failed: %v", index.Name, err)
+		}
+		if !newIndexed || (oldIndexed && fmt.Sprint(oldAttributes) == fmt.Sprint(newAttributes)) {
+			continue
+		}
+
+		key, err := index.entryKey(stub, newAttributes, rowKeys)
+		if err != nil {
+			return err
+		}
+		if released[key] {
+			continue
+		}
+		owner, err := getTableState(stub, key)
+		if err != nil {
+			return fmt.Errorf("stub.GetState(%v) failed with error %v", key, err)
+		}
+		if owner == nil {
+			continue
+		}
+		ownerKeys := make([]string, 0)
+		if err := json.Unmarshal(owner, &ownerKeys); err != nil {
+			return fmt.Errorf("unique constraint %s has an invalid entry: %v", index.Name, err)
+		}
+		if fmt.Sprint(ownerKeys) != fmt.Sprint(rowKeys) {
+			return &UniqueViolationError{Table: table, Constraint: index.Name, Values: attributeValues(newAttributes), RowKeys: ownerKeys}
+		}
+	}
+	return nil
+}
+
+// indexChanges are the index entries to delete and to write when rows change
+type indexChanges struct {
+	removed []string
+	added   []indexEntry
+}
+
+// indexEntry is an index entry to write
+type indexEntry struct {
+	key   string
+	value []byte
+}
+
+// updateTableIndexes replaces the index entries of a row whose value changed from oldRow to newRow, nil meaning no row
+func updateTableIndexes(stub shim.ChaincodeStubInterface, table string, rowKeys []string, oldRow []byte, newRow []byte) error {
+	changes := new(indexChanges)
+	if err := changes.add(stub, table, rowKeys, oldRow, newRow); err != nil {
+		return err
+	}
+	return changes.write(stub)
+}
+
+// add adds the changes of the index entries of a row whose value changes from oldRow to newRow
+func (changes *indexChanges) add(stub shim.ChaincodeStubInterface, table string, rowKeys []string, oldRow []byte, newRow []byte) error {
+	for _, index := range getTableIndexes(table) {
+		oldAttributes, oldIndexed, err := index.attributes(oldRow)
+		if err != nil {
+			return fmt.Errorf("index %s of the previous row failed: %v", index.Name, err)
+		}
+		newAttributes, newIndexed, err := index.attributes(newRow)
+		if err != nil {
+			return fmt.Errorf("index %s of the new row failed: %v", index.Name, err)
+		}
+		if oldIndexed == newIndexed && fmt.Sprint(oldAttributes) == fmt.Sprint(newAttributes) {
+			continue
+		}
+
+		if oldIndexed {
+			key, err := index.entryKey(stub, oldAttributes, rowKeys)
+			if err != nil {
+				return err
+			}
+			changes.removed = append(changes.removed, key)
+		}
+		if newIndexed {
+			key, err := index.entryKey(stub, newAttributes, rowKeys)
+			if err != nil {
+				return err
+			}
+			value, err := index.entryValue(rowKeys)
+			if err != nil {
+				return err
+			}
+			changes.added = append(changes.added, indexEntry{key: key, value: value})
+		}
+	}
+	return nil
+}
+
+// write deletes the removed entries before it writes the added ones,
+// so that a unique entry can move from a row to another
+func (changes *indexChanges) write(stub shim.ChaincodeStubInterface) error {
+	for _, key := range changes.removed {
+		if err := delTableState(stub, key); err != nil {
+			return fmt.Errorf("stub.DelState(%v) failed with error %v", key, err)
+		}
+	}
+	for _, entry := range changes.added {
+		if err := putTableState(stub, entry.key, entry.value); err != nil {
+			return fmt.Errorf("stub.PutState(%v) failed with error %v", entry.key, err)
+		}
+	}
+	return nil
+}
+
+// GetRowKeysByIndex returns the keys of the rows of table whose first index fields are values.
+// The values must have the JSON type of the fields, e.g. 42 and not "42" for a number field.
+func GetRowKeysByIndex(stub shim.ChaincodeStubInterface, table string, index string, values ...interface{}) ([][]string, error) {
+	tableIndex, err := getTableIndex(table, index)
+	if err != nil {
+		return nil, fmt.Errorf("GetRowKeysByIndex failed because %v", err)
+	}
+	if len(values) > len(tableIndex.Fields) {
+		return nil, fmt.Errorf("GetRowKeysByIndex failed because index %s has %d fields, %d values were given", index, len(tableIndex.Fields), len(values))
+	}
+
+	attributes, err := indexAttributes(values)
+	if err != nil {
+		return nil, fmt.Errorf("GetRowKeysByIndex failed because %v", err)
+	}
+	iterator, err := stub.GetStateByPartialCompositeKey(tableIndex.objectType(), attributes)
+	if err != nil {
+		return nil, fmt.Errorf("GetRowKeysByIndex failed because stub.GetStateByPartialCompositeKey failed with error %v", err)
+	}
+	defer iterator.Close()
+
+	rowKeys := make([][]string, 0)
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("GetRowKeysByIndex failed because the iterator failed with error %v", err)
+		}
+		if tableIndex.Unique {
+			keys := make([]string, 0)
+			if err := json.Unmarshal(kv.Value, &keys); err != nil {
+				return nil, fmt.Errorf("GetRowKeysByIndex failed because json.Unmarshal failed with error %v", err)
+			}
+			rowKeys = append(rowKeys, keys)
+			continue
+		}
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, fmt.Errorf("GetRowKeysByIndex failed because stub.SplitCompositeKey failed with error %v", err)
+		}
+		rowKeys = append(rowKeys, attributes[len(tableIndex.Fields):])
+	}
+	return rowKeys, nil
+}
+
+// GetTableRowsByIndex returns the JSON of the rows of table whose first index fields are values, see GetRowKeysByIndex
+func GetTableRowsByIndex(stub shim.ChaincodeStubInterface, table string, index string, values ...interface{}) ([][]byte, error) {
+	rowKeys, err := GetRowKeysByIndex(stub, table, index, values...)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([][]byte, 0, len(rowKeys))
+	for _, keys := range rowKeys {
+		key, err := stub.CreateCompositeKey(table, keys)
+		if err != nil {
+			return nil, fmt.Errorf("GetTableRowsByIndex failed because stub.CreateCompositeKey failed with error %v", err)
+		}
+		row, err := stub.GetState(key)
+		if err != nil {
+			return nil, fmt.Errorf("GetTableRowsByIndex failed because stub.GetState(%v) failed with error %v", key, err)
+		}
+		if row == nil {
+			return nil, fmt.Errorf("GetTableRowsByIndex failed because index %s refers to row %v that does not exist", index, keys)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -0,0 +1,119 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ErrStopIteration can be returned by the function of ForEachTableRow to stop without error
+var ErrStopIteration = errors.New("stop iteration")
+
+// TableRowIterator reads the rows of a table one at a time, in the transaction that created it.
+// Soft deleted rows are skipped. The iterator must be closed, also when the iteration stops early:
+//
+//	iterator, err := GetTableRowIterator(stub, "Data_", nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer iterator.Close()
+//	for iterator.Next() {
+//		row := iterator.Row()
+//		...
+//	}
+//	if err := iterator.Err(); err != nil {
+//		return err
+//	}
+type TableRowIterator struct {
+	table    string
+	iterator shim.StateQueryIteratorInterface
+	rowKeys  []string
+	row      []byte
+	err      error
+	closed   bool
+}
+
+// GetTableRowIterator returns an iterator over the rows of table_name whose first keys are row_keys
+func GetTableRowIterator(stub shim.ChaincodeStubInterface, table_name string, row_keys []string) (*TableRowIterator, error) {
+	state_query_iterator, err := stub.GetStateByPartialCompositeKey(table_name, row_keys)
+	if err != nil {
+		return nil, fmt.Errorf("GetTableRowIterator failed because stub.GetStateByPartialCompositeKey failed with error %v", err)
+	}
+	return &TableRowIterator{table: table_name, iterator: state_query_iterator}, nil
+}
+
+// Next moves to the next row. It returns false when there are no more rows, when the iterator
+// is closed or when reading failed, in which case Err returns the error.
+func (it *TableRowIterator) Next() bool {
+	it.row, it.rowKeys = nil, nil
+	for !it.closed && it.err == nil && it.iterator.HasNext() {
+		kv, err := it.iterator.Next()
+		if err != nil {
+			it.err = fmt.Errorf("the iterator over table %s failed with error %v", it.table, err)
+			return false
+		}
+		if isDeletedRow(it.table, kv.Value) {
+			continue
+		}
+		_, rowKeys, ok := splitCompositeKey(kv.Key)
+		if !ok {
+			it.err = fmt.Errorf("the iterator over table %s read key %q that is not a composite key", it.table, kv.Key)
+			return false
+		}
+		it.row, it.rowKeys = kv.Value, rowKeys
+		return true
+	}
+	return false
+}
+
+// Row returns the JSON of the current row
+func (it *TableRowIterator) Row() []byte {
+	return it.row
+}
+
+// RowKeys returns the keys of the current row
+func (it *TableRowIterator) RowKeys() []string {
+	return it.rowKeys
+}
+
+// Err returns the error that stopped the iteration, nil if it went to the end or was closed
+func (it *TableRowIterator) Err() error {
+	return it.err
+}
+
+// Close releases the query of the iterator, it can be called more than once
+func (it *TableRowIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.row, it.rowKeys = nil, nil
+	if err := it.iterator.Close(); err != nil {
+		return fmt.Errorf("the iterator over table %s could not be closed: %v", it.table, err)
+	}
+	return nil
+}
+
+// ForEachTableRow calls f with the JSON of every row of table_name whose first keys are row_keys.
+// It stops at the first error of f, which it returns unless it is ErrStopIteration.
+func ForEachTableRow(stub shim.ChaincodeStubInterface, table_name string, row_keys []string, f func(row []byte) error) error {
+	iterator, err := GetTableRowIterator(stub, table_name, row_keys)
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for iterator.Next() {
+		if err := f(iterator.Row()); err != nil {
+			if err == ErrStopIteration {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		return fmt.Errorf("ForEachTableRow failed because %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TableSchema holds the validation rules for the rows of a table. It is a subset of JSON Schema:
+//
+//	{
+//		"required": ["email"],
+//		"properties": {
+//			"email":  {"type": "string", "pattern": "^[^@]+@[^@]+$", "maxLength": 64},
+//			"age":    {"type": "integer", "minimum": 0, "maximum": 150},
+//			"status": {"enum": ["active", "closed"]}
+//		}
+//	}
+//
+// InsertTableRow and UpdateTableRow validate every row of the table before it is written.
+// A required field must be present and must not be null or an empty string.
+type TableSchema struct {
+	Required   []string                   `json:"required,omitempty"`
+	Properties map[string]*PropertySchema `json:"properties,omitempty"`
+}
+
+// PropertySchema holds the rules for one field of the rows. Rules that do not apply to the type
+// of a value are ignored, e.g. minLength for a number.
+type PropertySchema struct {
+	Type      string        `json:"type,omitempty"` // string, number, integer, boolean, object, array or null
+	Pattern   string        `json:"pattern,omitempty"`
+	MinLength *int          `json:"minLength,omitempty"` // length of strings in characters, of arrays in items
+	MaxLength *int          `json:"maxLength,omitempty"`
+	Minimum   *float64      `json:"minimum,omitempty"`
+	Maximum   *float64      `json:"maximum,omitempty"`
+	Enum      []interface{} `json:"enum,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// FieldViolation is a rule of a TableSchema that a field of a row breaks
+type FieldViolation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"` // required, type, pattern, minLength, maxLength, minimum, maximum or enum
+	Message string `json:"message"`
+}
+
+// DeclareSchema sets the validation rules of the rows of table, replacing the previous ones
+func DeclareSchema(table string, schema *TableSchema) error {
+	if table == "" || schema == nil {
+		return fmt.Errorf("DeclareSchema failed because the table and the schema are required")
+	}
+	if err := schema.compile(); err != nil {
+		return fmt.Errorf("DeclareSchema failed because %v", err)
+	}
+	return updateTableDefinition(table, func(definition *TableDefinition) error {
+		definition.Schema = schema
+		return nil
+	})
+}
+
+// compile checks the rules of the schema and compiles its patterns
+func (schema *TableSchema) compile() error {
+	for name, property := range schema.Properties {
+		if property == nil {
+			return fmt.Errorf("property %s has no schema", name)
+		}
+		if property.Pattern != "" {
+			pattern, err := regexp.Compile(property.Pattern)
+			if err != nil {
+				return fmt.Errorf("the pattern of property %s is invalid: %v", name, err)
+			}
+			property.pattern = pattern
+		}
+	}
+	return nil
+}
+
+// DeclareJSONSchema sets the validation rules of the rows of table from a JSON Schema document
+func DeclareJSONSchema(table string, document []byte) error {
+	schema := new(TableSchema)
+	if err := json.Unmarshal(document, schema); err != nil {
+		return fmt.Errorf("DeclareJSONSchema failed because json.Unmarshal failed with error %v", err)
+	}
+	return DeclareSchema(table, schema)
+}
+
+// getTableSchema returns the schema of table, nil if it has none
+func getTableSchema(table string) *TableSchema {
+	return getTableDefinition(table).Schema
+}
+
+// validateTableRow checks a JSON row against the schema of its table and returns
+// a SchemaViolationError listing every field that breaks a rule
+func validateTableRow(table string, row []byte) error {
+	schema := getTableSchema(table)
+	if schema == nil {
+		return nil
+	}
+	violations := schema.Validate(row)
+	if len(violations) > 0 {
+		return &SchemaViolationError{Table: table, Violations: violations}
+	}
+	return nil
+}
+
+// Validate returns the rules a JSON row breaks, sorted by field
+func (schema *TableSchema) Validate(row []byte) []FieldViolation {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(row, &fields); err != nil {
+		return []FieldViolation{{Rule: "type", Message: "row is not a JSON object"}}
+	}
+
+	violations := make([]FieldViolation, 0)
+	for _, name := range schema.Required {
+		if raw, ok := fields[name]; !ok || string(raw) == "null" || string(raw) == `""` {
+			violations = append(violations, FieldViolation{Field: name, Rule: "required", Message: "is required"})
+		}
+	}
+	for name, property := range schema.Properties {
+		if raw, ok := fields[name]; ok {
+			violations = append(violations, property.validate(name, raw)...)
+		}
+	}
+	sort.SliceStable(violations, func(i, j int) bool { return violations[i].Field < violations[j].Field })
+	return violations
+}
+
+// validate returns the rules a JSON value of field breaks
+func (property *PropertySchema) validate(field string, raw json.RawMessage) []FieldViolation {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return []FieldViolation{{Field: field, Rule: "type", Message: "is not valid JSON"}}
+	}
+
+	violations := make([]FieldViolation, 0)
+	violate := func(rule string, format string, args ...interface{}) {
+		violations = append(violations, FieldViolation{Field: field, Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+	if property.Type != "" && !hasJSONType(value, property.Type) {
+		violate("type", "must be of type %s", property.Type)
+		return violations
+	}
+
+	length := -1
+	switch v := value.(type) {
+	case string:
+		length = utf8.RuneCountInString(v)
+		if property.pattern != nil && !property.pattern.MatchString(v) {
+			violate("pattern", "must match %s", property.Pattern)
+		}
+	case []interface{}:
+		length = len(v)
+	case json.Number:
+		if n, err := v.Float64(); err == nil {
+			if property.Minimum != nil && n < *property.Minimum {
+				violate("minimum", "must be at least %v", *property.Minimum)
+			}
+			if property.Maximum != nil && n > *property.Maximum {
+				violate("maximum", "must be at most %v", *property.Maximum)
+			}
+		}
+	}
+	if length >= 0 && property.MinLength != nil && length < *property.MinLength {
+		violate("minLength", "must have a length of at least %d", *property.MinLength)
+	}
+	if length >= 0 && property.MaxLength != nil && length > *property.MaxLength {
+		violate("maxLength", "must have a length of at most %d", *property.MaxLength)
+	}
+	if len(property.Enum) > 0 && !inEnum(value, property.Enum) {
+		violate("enum", "must be one of %v", property.Enum)
+	}
+	return violations
+}
+
+// hasJSONType tells whether a decoded JSON value is of a JSON Schema type
+func hasJSONType(value interface{}, jsonType string) bool {
+	switch v := value.(type) {
+	case string:
+		return jsonType == "string"
+	case json.Number:
+		if jsonType == "number" {
+			return true
+		}
+		_, err := v.Int64()
+		return jsonType == "integer" && err == nil
+	case bool:
+		return jsonType == "boolean"
+	case map[string]interface{}:
+		return jsonType == "object"
+	case []interface{}:
+		return jsonType == "array"
+	case nil:
+		return jsonType == "null"
+	}
+	return false
+}
+
+// inEnum tells whether a decoded JSON value is one of the enum values, numbers are compared by value
+func inEnum(value interface{}, enum []interface{}) bool {
+	for _, allowed := range enum {
+		if n, ok := value.(json.Number); ok {
+			f, err := n.Float64()
+			if a, isNumber := toFloat(allowed); isNumber && err == nil && a == f {
+				return true
+			}
+			continue
+		}
+		if reflect.DeepEqual(value, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// addTagRule adds the validation rule of a struct tag directive to the schema of a field:
+// required, pattern,<regexp>, min,<n>, max,<n>, minlen,<n>, maxlen,<n> or enum,<value>|<value>...
+// It returns false if the directive is not a validation rule.
+func (schema *TableSchema) addTagRule(field reflect.StructField, d tagDirective) (bool, error) {
+	name := jsonFieldName(field)
+	property := schema.Properties[name]
+	if property == nil {
+		property = new(PropertySchema)
+	}
+
+	arg := strings.Join(d.args, ",") // patterns may contain commas
+	switch d.name {
+	case "required":
+		schema.Required = append(schema.Required, name)
+	case "pattern":
+		property.Pattern = arg
+	case "min", "max":
+		n, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return true, fmt.Errorf("%s of field %s is not a number: %s", d.name, field.Name, arg)
+		}
+		if d.name == "min" {
+			property.Minimum = &n
+		} else {
+			property.Maximum = &n
+		}
+	case "minlen", "maxlen":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return true, fmt.Errorf("%s of field %s is not a length: %s", d.name, field.Name, arg)
+		}
+		if d.name == "minlen" {
+			property.MinLength = &n
+		} else {
+			property.MaxLength = &n
+		}
+	case "enum":
+		if arg == "" {
+			return true, fmt.Errorf("enum of field %s has no values", field.Name)
+		}
+		for _, value := range strings.Split(arg, "|") {
+			var decoded interface{} = value
+			if field.Type.Kind() != reflect.String {
+				if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+					return true, fmt.Errorf("enum value %s of field %s is not valid JSON", value, field.Name)
+				}
+			}
+			property.Enum = append(property.Enum, decoded)
+		}
+	default:
+		return false, nil
+	}
+
+	if d.name != "required" {
+		if schema.Properties == nil {
+			schema.Properties = make(map[string]*PropertySchema)
+		}
+		schema.Properties[name] = property
+	}
+	return true, nil
+}
@@ -0,0 +1,189 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// deletedField is the reserved field of the tombstone of soft deleted rows.
+// Reserved fields start with '~' because CouchDB does not accept fields starting with '_'.
+const deletedField = "~deleted"
+
+// Tombstone records the deletion of a soft deleted row
+type Tombstone struct {
+	TxID      string `json:"txID"`
+	Timestamp string `json:"timestamp"` // transaction timestamp, RFC 3339
+}
+
+// DeletedTableRow is a soft deleted row, Value is the row as it was before the deletion
+type DeletedTableRow struct {
+	RowKeys   []string
+	Value     []byte
+	Tombstone Tombstone
+}
+
+// DeclareSoftDelete makes DeleteTableRow keep the rows of table with a tombstone instead of deleting them.
+// Soft deleted rows are hidden from GetTableRow, GetTableRows and the indexes, they can be listed with
+// ListDeletedTableRows, restored with RestoreTableRow and deleted for good with PurgeTableRow.
+func DeclareSoftDelete(table string) error {
+	if table == "" {
+		return fmt.Errorf("DeclareSoftDelete failed because the table is required")
+	}
+	return updateTableDefinition(table, func(definition *TableDefinition) error {
+		definition.SoftDelete = true
+		return nil
+	})
+}
+
+// isSoftDelete tells whether the rows of table are soft deleted
+func isSoftDelete(table string) bool {
+	return getTableDefinition(table).SoftDelete
+}
+
+// isDeletedRow tells whether a row of table has a tombstone
+func isDeletedRow(table string, row []byte) bool {
+	if row == nil || !isSoftDelete(table) {
+		return false
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(row, &fields); err != nil {
+		return false
+	}
+	_, deleted := fields[deletedField]
+	return deleted
+}
+
+// tombstoneRow adds the tombstone of the running transaction to a row
+func tombstoneRow(stub shim.ChaincodeStubInterface, row []byte) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(row, &fields); err != nil {
+		return nil, fmt.Errorf("the row is not a JSON object: %v", err)
+	}
+	timestamp, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	tombstone, err := json.Marshal(Tombstone{TxID: stub.GetTxID(), Timestamp: timestamp})
+	if err != nil {
+		return nil, err
+	}
+	fields[deletedField] = tombstone
+	return json.Marshal(fields)
+}
+
+// splitTombstone returns a soft deleted row without its tombstone, ok is false if the row has no tombstone
+func splitTombstone(row []byte) (value []byte, tombstone Tombstone, ok bool, err error) {
+	fields := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(row, &fields); err != nil {
+		return nil, tombstone, false, fmt.Errorf("the row is not a JSON object: %v", err)
+	}
+	raw, ok := fields[deletedField]
+	if !ok {
+		return row, tombstone, false, nil
+	}
+	if err = json.Unmarshal(raw, &tombstone); err != nil {
+		return nil, tombstone, false, fmt.Errorf("the tombstone of the row is invalid: %v", err)
+	}
+	delete(fields, deletedField)
+	value, err = json.Marshal(fields)
+	return value, tombstone, true, err
+}
+
+// getDeletedTableRow returns the composite key and the value without tombstone of a soft deleted row
+func getDeletedTableRow(stub shim.ChaincodeStubInterface, table string, rowKeys []string) (string, []byte, error) {
+	if !isSoftDelete(table) {
+		return "", nil, fmt.Errorf("table %s is not declared with DeclareSoftDelete", table)
+	}
+	compositeKey, err := stub.CreateCompositeKey(table, rowKeys)
+	if err != nil {
+		return "", nil, fmt.Errorf("stub.CreateCompositeKey failed with error %v", err)
+	}
+	row, err := getTableState(stub, compositeKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("stub.GetState(%v) failed with error %v", compositeKey, err)
+	}
+	if row == nil {
+		return "", nil, fmt.Errorf("row with keys %v does not exist", rowKeys)
+	}
+	value, _, deleted, err := splitTombstone(row)
+	if err != nil {
+		return "", nil, err
+	}
+	if !deleted {
+		return "", nil, fmt.Errorf("row with keys %v is not deleted", rowKeys)
+	}
+	return compositeKey, value, nil
+}
+
+// ListDeletedTableRows returns the soft deleted rows of table whose first keys are partialKeys
+func ListDeletedTableRows(stub shim.ChaincodeStubInterface, table string, partialKeys []string) ([]*DeletedTableRow, error) {
+	if !isSoftDelete(table) {
+		return nil, fmt.Errorf("ListDeletedTableRows failed because table %s is not declared with DeclareSoftDelete", table)
+	}
+	iterator, err := stub.GetStateByPartialCompositeKey(table, partialKeys)
+	if err != nil {
+		return nil, fmt.Errorf("ListDeletedTableRows failed because stub.GetStateByPartialCompositeKey failed with error %v", err)
+	}
+	defer iterator.Close()
+
+	deleted := make([]*DeletedTableRow, 0)
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("ListDeletedTableRows failed because the iterator failed with error %v", err)
+		}
+		value, tombstone, ok, err := splitTombstone(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("ListDeletedTableRows failed because %v", err)
+		}
+		if !ok {
+			continue
+		}
+		_, rowKeys, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, fmt.Errorf("ListDeletedTableRows failed because stub.SplitCompositeKey failed with error %v", err)
+		}
+		deleted = append(deleted, &DeletedTableRow{RowKeys: rowKeys, Value: value, Tombstone: tombstone})
+	}
+	return deleted, nil
+}
+
+// RestoreTableRow brings back a soft deleted row, it fails if the row would take the unique values of another row.
+// The restore is a write of the row: its version is incremented and its audit metadata updated.
+func RestoreTableRow(stub shim.ChaincodeStubInterface, table string, rowKeys []string) error {
+	compositeKey, deleted, err := getDeletedTableRow(stub, table, rowKeys)
+	if err != nil {
+		return fmt.Errorf("RestoreTableRow failed because %v", err)
+	}
+	row, err := stampRowVersion(table, rowKeys, deleted, deleted, nil)
+	if err != nil {
+		return fmt.Errorf("RestoreTableRow failed because stampRowVersion failed with error %w", err)
+	}
+	if row, err = stampRowAudit(stub, table, deleted, row); err != nil {
+		return fmt.Errorf("RestoreTableRow failed because stampRowAudit failed with error %w", err)
+	}
+	if err := checkUniqueConstraints(stub, table, rowKeys, nil, row, nil); err != nil {
+		return fmt.Errorf("RestoreTableRow failed because checkUniqueConstraints failed with error %w", err)
+	}
+	if err := putTableState(stub, compositeKey, row); err != nil {
+		return fmt.Errorf("RestoreTableRow failed because stub.PutState(%v) failed with error %v", compositeKey, err)
+	}
+	if err := updateTableIndexes(stub, table, rowKeys, nil, row); err != nil {
+		return fmt.Errorf("RestoreTableRow failed because updateTableIndexes failed with error %v", err)
+	}
+	return nil
+}
+
+// PurgeTableRow deletes a soft deleted row from the state
+func PurgeTableRow(stub shim.ChaincodeStubInterface, table string, rowKeys []string) error {
+	compositeKey, _, err := getDeletedTableRow(stub, table, rowKeys)
+	if err != nil {
+		return fmt.Errorf("PurgeTableRow failed because %v", err)
+	}
+	if err := delTableState(stub, compositeKey); err != nil {
+		return fmt.Errorf("PurgeTableRow failed because stub.DelState(%v) failed with error %v", compositeKey, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package util
+
+import (
+	"sync"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// tableTxState holds the rows and index entries that the table functions wrote in a transaction.
+// A peer answers GetState with the state committed before the transaction, without its own writes,
+// so the table functions read what they wrote from here: two rows cannot take the same unique values
+// and a row written twice replaces its own index entries, as if each write saw the previous one.
+type tableTxState struct {
+	mutex  sync.Mutex
+	writes map[string][]byte // value written by key, nil if the key was deleted
+}
+
+// tableTxStater is implemented by stubs that keep the table state of their transaction
+type tableTxStater interface {
+	tableTxState() *tableTxState
+}
+
+func newTableTxState() *tableTxState {
+	return &tableTxState{writes: make(map[string][]byte)}
+}
+
+// TableTxStub is a stub that keeps what the table functions write in its transaction. Without it, the table
+// functions only see the state committed before the transaction on a peer: writing the same row twice, or the
+// same unique values in two rows, in one transaction is not checked against the first write. Wrap the stub at
+// the start of Invoke, what it keeps is dropped with it when Invoke returns:
+//
+//	func (s *Chaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+//		stub = util.NewTableTxStub(stub)
+//		...
+//	}
+//
+// MockStubExtend keeps the same for each of its transactions and does not need to be wrapped.
+type TableTxStub struct {
+	shim.ChaincodeStubInterface
+	state *tableTxState
+}
+
+// NewTableTxStub wraps the stub of a transaction, see TableTxStub
+func NewTableTxStub(stub shim.ChaincodeStubInterface) *TableTxStub {
+	return &TableTxStub{ChaincodeStubInterface: stub, state: newTableTxState()}
+}
+
+func (stub *TableTxStub) tableTxState() *tableTxState {
+	return stub.state
+}
+
+// getTableTxState returns the table state of the transaction of stub, nil if the stub does not keep one
+func getTableTxState(stub shim.ChaincodeStubInterface) *tableTxState {
+	if stater, ok := stub.(tableTxStater); ok {
+		return stater.tableTxState()
+	}
+	return nil
+}
+
+// get returns the value written for key, ok is false if the transaction did not write it
+func (state *tableTxState) get(key string) (value []byte, ok bool) {
+	if state == nil {
+		return nil, false
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	value, ok = state.writes[key]
+	return value, ok
+}
+
+// set keeps the value written for key, nil if it was deleted
+func (state *tableTxState) set(key string, value []byte) {
+	if state == nil {
+		return
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.writes[key] = append([]byte(nil), value...) // nil for an empty value, which deletes the key
+}
+
+// getTableState returns the value of a key as the table functions wrote it in the transaction, or the
+// committed value if they did not. The key is read from the stub anyway so that it is in the read set.
+func getTableState(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
+	value, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if written, ok := getTableTxState(stub).get(key); ok {
+		return written, nil
+	}
+	return value, nil
+}
+
+// putTableState writes a key and keeps its value for the next reads of the transaction
+func putTableState(stub shim.ChaincodeStubInterface, key string, value []byte) error {
+	if err := stub.PutState(key, value); err != nil {
+		return err
+	}
+	getTableTxState(stub).set(key, value)
+	return nil
+}
+
+// delTableState deletes a key and keeps its deletion for the next reads of the transaction
+func delTableState(stub shim.ChaincodeStubInterface, key string) error {
+	if err := stub.DelState(key); err != nil {
+		return err
+	}
+	getTableTxState(stub).set(key, nil)
+	return nil
+}
@@ -0,0 +1,89 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// DeclareVersionField makes the rows of table carry their version in the JSON field named field.
+// The version of a new row is 1 and every write increments it. A write must carry the version of the
+// row it replaces, 0 for a new row, otherwise it fails with a VersionConflictError: a client that read
+// a row in a transaction cannot overwrite the changes made to it by another transaction since.
+func DeclareVersionField(table string, field string) error {
+	if table == "" || field == "" {
+		return fmt.Errorf("DeclareVersionField failed because the table and the field are required")
+	}
+	err := updateTableDefinition(table, func(definition *TableDefinition) error {
+		return definition.setVersionField(field)
+	})
+	if err != nil {
+		return fmt.Errorf("DeclareVersionField failed because %v", err)
+	}
+	return nil
+}
+
+// getVersionField returns the version field of table, ok is false if its rows are not versioned
+func getVersionField(table string) (field string, ok bool) {
+	field = getTableDefinition(table).VersionField
+	return field, field != ""
+}
+
+// GetRowVersion returns the version of a JSON row of table, 0 for a nil row or a row without version
+func GetRowVersion(table string, row []byte) (int64, error) {
+	field, ok := getVersionField(table)
+	if !ok {
+		return 0, fmt.Errorf("GetRowVersion failed because table %s has no version field", table)
+	}
+	if row == nil {
+		return 0, nil
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(row, &fields); err != nil {
+		return 0, fmt.Errorf("GetRowVersion failed because the row is not a JSON object: %v", err)
+	}
+	return parseVersion(field, fields[field])
+}
+
+func parseVersion(field string, raw json.RawMessage) (int64, error) {
+	if raw == nil || string(raw) == "null" {
+		return 0, nil
+	}
+	var version int64
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return 0, fmt.Errorf("version field %s is not an integer: %s", field, raw)
+	}
+	return version, nil
+}
+
+// stampRowVersion checks the version of a row written over oldRow, nil meaning no row, and returns the row
+// with the next version. The expected version is the one of newRow, unless expected is given.
+// Rows of tables without a version field are returned as they are.
+func stampRowVersion(table string, rowKeys []string, oldRow []byte, newRow []byte, expected *int64) ([]byte, error) {
+	field, ok := getVersionField(table)
+	if !ok {
+		return newRow, nil
+	}
+	stored, err := GetRowVersion(table, oldRow)
+	if err != nil {
+		return nil, fmt.Errorf("the stored row has an invalid version: %v", err)
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(newRow, &fields); err != nil {
+		return nil, fmt.Errorf("the row is not a JSON object: %v", err)
+	}
+	if expected == nil {
+		version, err := parseVersion(field, fields[field])
+		if err != nil {
+			return nil, err
+		}
+		expected = &version
+	}
+	if *expected != stored {
+		return nil, &VersionConflictError{Table: table, RowKeys: rowKeys, Expected: *expected, Actual: stored}
+	}
+
+	fields[field] = json.RawMessage(strconv.FormatInt(stored+1, 10))
+	return json.Marshal(fields)
+}
@@ -0,0 +1,157 @@
+package util
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TxCost counts what a mock transaction asked of the ledger
+type TxCost struct {
+	GetState         int // GetState calls
+	PutState         int // PutState calls
+	DelState         int // DelState calls
+	GetPrivateData   int // GetPrivateData calls
+	PutPrivateData   int // PutPrivateData calls
+	BytesRead        int // size of the values read, by GetState, queries and private data reads
+	BytesWritten     int // size of the values written, by PutState and PutPrivateData
+	RichQueries      int // GetQueryResult and GetQueryResultWithPagination calls
+	RichQueryResults int // rows returned by rich queries
+	RangeScans       int // GetStateByRange and GetStateByPartialCompositeKey calls
+	RangeScanResults int // rows returned by range scans
+}
+
+// TxBudget is the most a transaction may cost, by TxCost field name, e.g. TxBudget{"GetState": 2, "PutState": 1}.
+// The fields that are not in the budget are not limited.
+type TxBudget map[string]int
+
+// LastTxCost returns what the last mock transaction asked of the ledger
+func (stub *MockStubExtend) LastTxCost() TxCost {
+	if stub.lastTx == nil {
+		return TxCost{}
+	}
+	return stub.lastTx.cost
+}
+
+// String lists the counters that are not zero
+func (cost TxCost) String() string {
+	v := reflect.ValueOf(cost)
+	s := ""
+	for i := 0; i < v.NumField(); i++ {
+		if n := v.Field(i).Int(); n != 0 {
+			if s != "" {
+				s += " "
+			}
+			s += fmt.Sprintf("%s=%d", v.Type().Field(i).Name, n)
+		}
+	}
+	return s
+}
+
+// Exceeds returns a description of every limit of budget the cost is above
+func (cost TxCost) Exceeds(budget TxBudget) ([]string, error) {
+	v := reflect.ValueOf(cost)
+	names := make([]string, 0, len(budget))
+	for name := range budget {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	exceeded := make([]string, 0)
+	for _, name := range names {
+		field := v.FieldByName(name)
+		if !field.IsValid() {
+			return nil, fmt.Errorf("budget limits unknown counter %s", name)
+		}
+		if n := int(field.Int()); n > budget[name] {
+			exceeded = append(exceeded, fmt.Sprintf("%s is %d, budget is %d", name, n, budget[name]))
+		}
+	}
+	return exceeded, nil
+}
+
+// AssertTxBudget checks the cost of the last mock transaction against budget and reports every exceeded limit to t
+func AssertTxBudget(t testing.TB, stub *MockStubExtend, budget TxBudget) {
+	t.Helper()
+	cost := stub.LastTxCost()
+	exceeded, err := cost.Exceeds(budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range exceeded {
+		t.Errorf("transaction %s is over budget: %s (cost: %s)", stub.lastTx.txID, e, cost)
+	}
+}
+
+// countRead adds a GetState call to the cost of the running transaction
+func (stub *MockStubExtend) countRead(value []byte) {
+	if stub.tx == nil {
+		return
+	}
+	stub.tx.cost.GetState++
+	stub.tx.cost.BytesRead += len(value)
+}
+
+// countWrite adds a PutState call to the cost of the running transaction
+func (stub *MockStubExtend) countWrite(value []byte) {
+	if stub.tx == nil {
+		return
+	}
+	stub.tx.cost.PutState++
+	stub.tx.cost.BytesWritten += len(value)
+}
+
+// countDelete adds a DelState call to the cost of the running transaction
+func (stub *MockStubExtend) countDelete() {
+	if stub.tx == nil {
+		return
+	}
+	stub.tx.cost.DelState++
+}
+
+// countPrivateDataRead adds a GetPrivateData call to the cost of the running transaction
+func (stub *MockStubExtend) countPrivateDataRead(value []byte) {
+	if stub.tx == nil {
+		return
+	}
+	stub.tx.cost.GetPrivateData++
+	stub.tx.cost.BytesRead += len(value)
+}
+
+// countPrivateDataWrite adds a PutPrivateData call to the cost of the running transaction
+func (stub *MockStubExtend) countPrivateDataWrite(value []byte) {
+	if stub.tx == nil {
+		return
+	}
+	stub.tx.cost.PutPrivateData++
+	stub.tx.cost.BytesWritten += len(value)
+}
+
+// countRangeScan adds a range scan and the rows it returned to the cost of the running transaction
+func (stub *MockStubExtend) countRangeScan(iterator *AkcQueryIterator) {
+	if stub.tx == nil {
+		return
+	}
+	stub.tx.cost.RangeScans++
+	stub.tx.cost.RangeScanResults += len(iterator.data)
+	stub.tx.cost.BytesRead += resultBytes(iterator)
+}
+
+// countRichQuery adds a rich query and the rows it returned to the cost of the running transaction
+func (stub *MockStubExtend) countRichQuery(iterator *AkcQueryIterator) {
+	if stub.tx == nil {
+		return
+	}
+	stub.tx.cost.RichQueries++
+	stub.tx.cost.RichQueryResults += len(iterator.data)
+	stub.tx.cost.BytesRead += resultBytes(iterator)
+}
+
+func resultBytes(iterator *AkcQueryIterator) int {
+	n := 0
+	for _, item := range iterator.data {
+		n += len(item.Value)
+	}
+	return n
+}
@@ -37,14 +37,15 @@ const (
 	FAIL_IF_MISSING      GetTableRow_FailureOption = true
 )
 
-// Implementation of GetTableKey that returns the composite key, if the row was found, and error.
+// Implementation of GetTableKey that returns the composite key, the JSON of the row (nil if it was not found),
+// if the row was found, and error.
 func getTableRowAndCompositeKey(
 	stub shim.ChaincodeStubInterface,
 	table_name string,
 	row_keys []string,
 	row_value interface{},
 	failure_option GetTableRow_FailureOption,
-) (composite_key string, rowWasFound bool, err error) {
+) (composite_key string, bytes []byte, rowWasFound bool, err error) {
 	// Initialize this to default not-found.
 	rowWasFound = false
 
@@ -58,8 +59,7 @@ func getTableRowAndCompositeKey(
 
 	//     fmt.Printf("getTableRowAndCompositeKey; table_name = \"%s\", composite_key (may contain unprintable chars) = \"%s\", row_value = %v, InterfaceIsNilOrIsZeroOfUnderlyingType(row_value) = %v\n", table_name, composite_key, row_value, InterfaceIsNilOrIsZeroOfUnderlyingType(row_value))
 
-	var bytes []byte
-	bytes, err = stub.GetState(composite_key)
+	bytes, err = getTableState(stub, composite_key)
 	if err != nil {
 		// Regardless of failure option, we will be returning due to this error.
 		if failure_option == FAIL_IF_MISSING {
@@ -69,6 +69,10 @@ func getTableRowAndCompositeKey(
 		}
 		return
 	}
+	if isDeletedRow(table_name, bytes) {
+		// Soft deleted rows are read as missing rows
+		bytes = nil
+	}
 	if bytes == nil {
 		// Regardless of failure option, we will be returning due to this bytes == nil condition.
 		if failure_option == FAIL_IF_MISSING {
@@ -105,36 +109,76 @@ func GetTableRow(
 	row_value interface{},
 	failure_option GetTableRow_FailureOption,
 ) (rowWasFound bool, err error) {
-	_, rowWasFound, err = getTableRowAndCompositeKey(stub, table_name, row_keys, row_value, failure_option)
+	_, _, rowWasFound, err = getTableRowAndCompositeKey(stub, table_name, row_keys, row_value, failure_option)
 	return
 }
 
-// If row_value is nil, then don't bother unmarshaling the data.  Thus a check for the
-// presence of a particular table row can be done by specifying nil for row_value.
+// GetTableRows returns a closed channel holding the JSON of the rows of table_name whose first keys are row_keys.
+// Every row is read before it returns, use GetTableRowIterator or ForEachTableRow to read them one at a time.
 func GetTableRows(
 	stub shim.ChaincodeStubInterface,
 	table_name string,
 	row_keys []string,
 ) (chan []byte, error) {
-	state_query_iterator, err := stub.GetStateByPartialCompositeKey(table_name, row_keys)
+	rows := make([][]byte, 0)
+	err := ForEachTableRow(stub, table_name, row_keys, func(row []byte) error {
+		rows = append(rows, row)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("GetTableRow failed because stub.CreateCompositeKey failed with error %v", err)
+		return nil, fmt.Errorf("GetTableRows failed because %v", err)
 	}
 
-	rowJSONBytesChannel := make(chan []byte, 32) // TODO: 32 is arbitrary; is there some other reasonable buffer size?
+	rowJSONBytesChannel := make(chan []byte, len(rows))
+	for _, row := range rows {
+		rowJSONBytesChannel <- row
+	}
+	close(rowJSONBytesChannel)
+	return rowJSONBytesChannel, nil
+}
 
-	go func() {
-		for state_query_iterator.HasNext() {
-			query_result_kv, err := state_query_iterator.Next()
-			if err != nil {
-				panic("this should never happen probably")
-			}
-			rowJSONBytesChannel <- query_result_kv.Value
-		}
-		close(rowJSONBytesChannel)
-	}()
+// TableRowsPage is a page of the rows of a table
+type TableRowsPage struct {
+	Rows                [][]byte // JSON of the rows, soft deleted rows are left out
+	Bookmark            string   // bookmark of the next page, empty on the last page
+	FetchedRecordsCount int32    // number of rows read from the state, soft deleted rows included
+}
 
-	return rowJSONBytesChannel, nil
+// GetTableRowsWithPagination returns at most page_size rows of table_name whose first keys are row_keys,
+// starting at bookmark. An empty bookmark starts from the first row.
+// Fabric only allows paginated queries in read-only transactions: a transaction that also writes fails
+// on the peer, so call it from query functions only.
+// Soft deleted rows count in FetchedRecordsCount and in the page size but are left out of Rows,
+// so a page can hold fewer than page_size rows even when it is not the last one.
+func GetTableRowsWithPagination(
+	stub shim.ChaincodeStubInterface,
+	table_name string,
+	row_keys []string,
+	page_size int32,
+	bookmark string,
+) (*TableRowsPage, error) {
+	state_query_iterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(table_name, row_keys, page_size, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("GetTableRowsWithPagination failed because stub.GetStateByPartialCompositeKeyWithPagination failed with error %v", err)
+	}
+	defer state_query_iterator.Close()
+
+	page := &TableRowsPage{Rows: make([][]byte, 0)}
+	if metadata != nil {
+		page.Bookmark = metadata.Bookmark
+		page.FetchedRecordsCount = metadata.FetchedRecordsCount
+	}
+	for state_query_iterator.HasNext() {
+		query_result_kv, err := state_query_iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("GetTableRowsWithPagination failed because the iterator failed with error %v", err)
+		}
+		if isDeletedRow(table_name, query_result_kv.Value) {
+			continue
+		}
+		page.Rows = append(page.Rows, query_result_kv.Value)
+	}
+	return page, nil
 }
 
 // This is effectively a strongly typed enum declaration.
@@ -146,6 +190,48 @@ const (
 	FAIL_UNLESS_OVERWRITE    InsertTableRow_FailureOption = 2
 )
 
+// prepareTableRow checks a JSON row written over oldRow, nil meaning no row, against the schema, the version and
+// the unique constraints of its table, and returns it with its next version and audit metadata
+func prepareTableRow(
+	stub shim.ChaincodeStubInterface,
+	table_name string,
+	row_keys []string,
+	oldRow []byte,
+	row []byte,
+	expected_version *int64,
+) ([]byte, error) {
+	row, err := stampTableRow(stub, table_name, row_keys, oldRow, row, expected_version)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUniqueConstraints(stub, table_name, row_keys, oldRow, row, nil); err != nil {
+		return nil, fmt.Errorf("checkUniqueConstraints failed with error %w", err)
+	}
+	return row, nil
+}
+
+// stampTableRow is prepareTableRow without the unique constraints
+func stampTableRow(
+	stub shim.ChaincodeStubInterface,
+	table_name string,
+	row_keys []string,
+	oldRow []byte,
+	row []byte,
+	expected_version *int64,
+) ([]byte, error) {
+	if err := validateTableRow(table_name, row); err != nil {
+		return nil, fmt.Errorf("validateTableRow failed with error %w", err)
+	}
+	row, err := stampRowVersion(table_name, row_keys, oldRow, row, expected_version)
+	if err != nil {
+		return nil, fmt.Errorf("stampRowVersion failed with error %w", err)
+	}
+	if row, err = stampRowAudit(stub, table_name, oldRow, row); err != nil {
+		return nil, fmt.Errorf("stampRowAudit failed with error %w", err)
+	}
+	return row, nil
+}
+
 // NOTE: This is the current abstraction to port old v0.6 style tables to current non-tables style ledger.
 // Note that row_value must be json.Marshal-able.
 // If old_row_value is not nil and the requested row is present, then the row will be unmarshaled into
@@ -170,7 +256,7 @@ func InsertTableRow(
 	}
 
 	// Check for the row's presence and retrieve its value into old_row_value if specified
-	composite_key, rowWasFound, err := getTableRowAndCompositeKey(stub, table_name, row_keys, old_row_value, DONT_FAIL_IF_MISSING)
+	composite_key, old_bytes, rowWasFound, err := getTableRowAndCompositeKey(stub, table_name, row_keys, old_row_value, DONT_FAIL_IF_MISSING)
 	if err != nil {
 		err = fmt.Errorf("InsertTableRow failed because getTableRowAndCompositeKey failed with error %v", err)
 		return
@@ -192,13 +278,26 @@ func InsertTableRow(
 		return
 	}
 
+	// Check the row against the previous one and stamp its version and audit metadata
+	bytes, err = prepareTableRow(stub, table_name, row_keys, old_bytes, bytes, nil)
+	if err != nil {
+		err = fmt.Errorf("InsertTableRow failed because %w", err)
+		return
+	}
+
 	// Store the data in the ledger state
-	err = stub.PutState(composite_key, bytes)
+	err = putTableState(stub, composite_key, bytes)
 	if err != nil {
 		err = fmt.Errorf("InsertTableRow failed because stub.PutState(%v) failed with error %v", composite_key, err)
 		return
 	}
 
+	err = updateTableIndexes(stub, table_name, row_keys, old_bytes, bytes)
+	if err != nil {
+		err = fmt.Errorf("InsertTableRow failed because updateTableIndexes failed with error %v", err)
+		return
+	}
+
 	// Return with success.
 	err = nil
 	return
@@ -210,33 +309,79 @@ func UpdateTableRow(
 	table_name string,
 	row_keys []string,
 	new_row_value interface{},
+) (err error) {
+	return updateTableRow(stub, table_name, row_keys, new_row_value, nil, "UpdateTableRow")
+}
+
+// UpdateTableRowIfVersion is similar to UpdateTableRow for tables with a version field, but it writes the row only
+// if the stored row is at expected_version, whatever the version of new_row_value, and fails with a VersionConflictError otherwise
+func UpdateTableRowIfVersion(
+	stub shim.ChaincodeStubInterface,
+	table_name string,
+	row_keys []string,
+	new_row_value interface{},
+	expected_version int64,
+) (err error) {
+	if _, versioned := getVersionField(table_name); !versioned {
+		return fmt.Errorf("UpdateTableRowIfVersion failed because table %s has no version field", table_name)
+	}
+	return updateTableRow(stub, table_name, row_keys, new_row_value, &expected_version, "UpdateTableRowIfVersion")
+}
+
+func updateTableRow(
+	stub shim.ChaincodeStubInterface,
+	table_name string,
+	row_keys []string,
+	new_row_value interface{},
+	expected_version *int64,
+	operation string,
 ) (err error) {
 	err = nil
 
 	// Check that new_row_value is valid (must be specified)
 	if InterfaceIsNilOrIsZeroOfUnderlyingType(new_row_value) {
-		err = fmt.Errorf("InsertTableRow failed because new_row_value was nil")
+		err = fmt.Errorf("%s failed because new_row_value was nil", operation)
 		return
 	}
 
 	// Form the composite key that will index this table row in the ledger state key/value store.
 	compositeKey, err := stub.CreateCompositeKey(table_name, row_keys)
 	if err != nil {
-		err = fmt.Errorf("GetTableRow failed because stub.CreateCompositeKey failed with error %v", err)
+		err = fmt.Errorf("%s failed because stub.CreateCompositeKey failed with error %v", operation, err)
 		return
 	}
 
 	// Serialize Member struct as JSON
 	bytes, err := json.Marshal(new_row_value)
 	if err != nil {
-		err = fmt.Errorf("InsertTableRow failed because json.Marshal failed with error %v", err)
+		err = fmt.Errorf("%s failed because json.Marshal failed with error %v", operation, err)
+		return
+	}
+
+	// Keep the previous row to replace its secondary index entries and check its version
+	oldBytes, err := getPreviousRow(stub, table_name, compositeKey)
+	if err != nil {
+		err = fmt.Errorf("%s failed because stub.GetState(%v) failed with error %v", operation, compositeKey, err)
+		return
+	}
+
+	// Check the row and stamp its version and audit metadata
+	bytes, err = prepareTableRow(stub, table_name, row_keys, oldBytes, bytes, expected_version)
+	if err != nil {
+		err = fmt.Errorf("%s failed because %w", operation, err)
 		return
 	}
 
 	// Store the data in the ledger state
-	err = stub.PutState(compositeKey, bytes)
+	err = putTableState(stub, compositeKey, bytes)
 	if err != nil {
-		err = fmt.Errorf("InsertTableRow failed because stub.PutState(%v) failed with error %v", compositeKey, err)
+		err = fmt.Errorf("%s failed because stub.PutState(%v) failed with error %v", operation, compositeKey, err)
+		return
+	}
+
+	err = updateTableIndexes(stub, table_name, row_keys, oldBytes, bytes)
+	if err != nil {
+		err = fmt.Errorf("%s failed because updateTableIndexes failed with error %v", operation, err)
 		return
 	}
 
@@ -257,7 +402,7 @@ func DeleteTableRow(
 	err = nil
 
 	// Check for the row's presence and retrieve its value into old_row_value if specified
-	composite_key, rowWasFound, err := getTableRowAndCompositeKey(stub, table_name, row_keys, old_row_value, DONT_FAIL_IF_MISSING)
+	composite_key, old_bytes, rowWasFound, err := getTableRowAndCompositeKey(stub, table_name, row_keys, old_row_value, DONT_FAIL_IF_MISSING)
 	if err != nil {
 		err = fmt.Errorf("DeleteTableRow failed because getTableRowAndCompositeKey failed with error %v", err)
 		return
@@ -269,10 +414,37 @@ func DeleteTableRow(
 		return
 	}
 
-	// Actually delete the row
-	err = stub.DelState(composite_key)
+	// Soft deleted rows are kept, missing ones have nothing to delete
+	soft_delete := isSoftDelete(table_name)
+	if soft_delete && !rowWasFound {
+		return
+	}
+
+	if soft_delete {
+		// Mark the row deleted
+		var bytes []byte
+		bytes, err = tombstoneRow(stub, old_bytes)
+		if err != nil {
+			err = fmt.Errorf("DeleteTableRow failed because tombstoneRow failed with error %v", err)
+			return
+		}
+		err = putTableState(stub, composite_key, bytes)
+		if err != nil {
+			err = fmt.Errorf("DeleteTableRow failed because stub.PutState(%v) failed with error %v", composite_key, err)
+			return
+		}
+	} else {
+		// Actually delete the row
+		err = delTableState(stub, composite_key)
+		if err != nil {
+			err = fmt.Errorf("DeleteTableRow failed because stub.DelState(%v) failed with error %v", composite_key, err)
+			return
+		}
+	}
+
+	err = updateTableIndexes(stub, table_name, row_keys, old_bytes, nil)
 	if err != nil {
-		err = fmt.Errorf("DeleteTableRow failed because stub.DelState(%v) failed with error %v", composite_key, err)
+		err = fmt.Errorf("DeleteTableRow failed because updateTableIndexes failed with error %v", err)
 		return
 	}
 
@@ -283,8 +455,14 @@ func DeleteTableRow(
 
 // MockInvokeTransaction creates a mock invoke transaction using MockStubExtend
 func MockInvokeTransaction(t *testing.T, stub *MockStubExtend, args [][]byte) string {
+	return MockInvokeTransactionWithTransient(t, stub, args, nil)
+}
+
+// MockInvokeTransactionWithTransient creates a mock invoke transaction using MockStubExtend
+// and passes the transient map to the chaincode through GetTransient
+func MockInvokeTransactionWithTransient(t *testing.T, stub *MockStubExtend, args [][]byte, transient map[string][]byte) string {
 	txId := genTxID()
-	res := stub.MockInvoke(txId, args)
+	res := stub.MockInvokeWithTransient(txId, args, transient)
 	if res.Status != shim.OK {
 		return string(res.Message)
 	}
@@ -292,10 +470,14 @@ func MockInvokeTransaction(t *testing.T, stub *MockStubExtend, args [][]byte) st
 	return string(res.Payload)
 }
 
-// MockQueryTransaction creates a mock query transaction using MockStubExtend
+// MockQueryTransaction creates a read-only mock query transaction using MockStubExtend.
+// The test fails if the chaincode writes anything, and the writes are discarded.
 func MockQueryTransaction(t *testing.T, stub *MockStubExtend, args [][]byte) string {
 	txId := genTxID()
-	res := stub.MockInvoke(txId, args)
+	res := stub.MockQuery(txId, args)
+	if rwset := stub.LastTxRWSet(); rwset != nil && rwset.HasWrites() {
+		t.Errorf("query transaction %s must not write to the ledger, discarded:\n%s", txId, rwset.Diff())
+	}
 	if res.Status != shim.OK {
 		t.FailNow()
 		return string(res.Message)
@@ -305,8 +487,14 @@ func MockQueryTransaction(t *testing.T, stub *MockStubExtend, args [][]byte) str
 
 // MockIInit creates a mock invoke transaction using MockStubExtend
 func MockInitTransaction(t *testing.T, stub *MockStubExtend, args [][]byte) string {
+	return MockInitTransactionWithTransient(t, stub, args, nil)
+}
+
+// MockInitTransactionWithTransient creates a mock init transaction using MockStubExtend
+// and passes the transient map to the chaincode through GetTransient
+func MockInitTransactionWithTransient(t *testing.T, stub *MockStubExtend, args [][]byte, transient map[string][]byte) string {
 	txId := genTxID()
-	res := stub.MockInit(txId, args)
+	res := stub.MockInitWithTransient(txId, args, transient)
 	if res.Status != shim.OK {
 		return string(res.Message)
 	}